@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// API key scopes. Session tokens obtained through /login have every scope
+const (
+	ScopeReadEntries  = "read-entries"
+	ScopeWriteEntries = "write-entries"
+	ScopeReportsOnly  = "reports-only"
+)
+
+var validScopes = map[string]bool{
+	ScopeReadEntries:  true,
+	ScopeWriteEntries: true,
+	ScopeReportsOnly:  true,
+}
+
+// API keys start with this prefix, which tells them apart from session tokens
+const apiKeyPrefix = "iwk_"
+
+type apiKey struct {
+	Id          primitive.ObjectID `bson:"_id" json:"id"`
+	UserId      primitive.ObjectID `bson:"user" json:"-"`
+	Name        string             `bson:"name" json:"name"`
+	Hint        string             `bson:"hint" json:"hint"`
+	KeyHash     string             `bson:"keyHash" json:"-"`
+	Scopes      []string           `bson:"scopes" json:"scopes"`
+	Expires     *time.Time         `bson:"expires,omitempty" json:"expires,omitempty"`
+	IpAllowlist []string           `bson:"ipAllowlist" json:"ipAllowlist"`
+	CreateTime  time.Time          `bson:"createTime" json:"createTime"`
+	LastUsed    *time.Time         `bson:"lastUsed,omitempty" json:"lastUsed,omitempty"`
+}
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// checkIpAllowlist checks whether the IP matches any of the IPs or CIDR ranges in the allowlist.
+// An empty allowlist allows every IP
+func checkIpAllowlist(ip string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return false
+	}
+	for _, allowed := range allowlist {
+		if strings.Contains(allowed, "/") {
+			_, network, err := net.ParseCIDR(allowed)
+			if err == nil && network.Contains(parsedIp) {
+				return true
+			}
+		} else if allowedIp := net.ParseIP(allowed); allowedIp != nil && allowedIp.Equal(parsedIp) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Create an API key for the user
+ * @param userId The owner of the key
+ * @param name A name to recognize the key by
+ * @param scopes The scopes granted to the key
+ * @param expires The expiry time of the key, or nil if it does not expire
+ * @param ipAllowlist The IPs or CIDR ranges allowed to use the key, empty for any
+ * @return The stored key, the plain key which is not stored and cannot be shown again, error
+ */
+func createApiKey(userId primitive.ObjectID, name string, scopes []string, expires *time.Time, ipAllowlist []string) (apiKey, string, error) {
+	if len(scopes) == 0 {
+		return apiKey{}, "", errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return apiKey{}, "", errors.New("invalid scope: " + scope)
+		}
+	}
+	for _, allowed := range ipAllowlist {
+		_, _, cidrErr := net.ParseCIDR(allowed)
+		if cidrErr != nil && net.ParseIP(allowed) == nil {
+			return apiKey{}, "", errors.New("invalid IP or CIDR range: " + allowed)
+		}
+	}
+	if ipAllowlist == nil {
+		ipAllowlist = []string{}
+	}
+
+	secret, err := generateSecureRandomString(40)
+	if err != nil {
+		return apiKey{}, "", err
+	}
+	plainKey := apiKeyPrefix + secret
+
+	key := apiKey{
+		Id:          primitive.NewObjectID(),
+		UserId:      userId,
+		Name:        name,
+		Hint:        plainKey[:len(apiKeyPrefix)+4] + "...",
+		KeyHash:     hashApiKey(plainKey),
+		Scopes:      scopes,
+		Expires:     expires,
+		IpAllowlist: ipAllowlist,
+		CreateTime:  time.Now(),
+	}
+	_, err = getApiKeysColl().InsertOne(context.TODO(), key)
+	if err != nil {
+		return apiKey{}, "", err
+	}
+	return key, plainKey, nil
+}
+
+func getApiKeys(userId primitive.ObjectID) ([]apiKey, error) {
+	cursor, err := getApiKeysColl().Find(context.TODO(), bson.M{"user": userId})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []apiKey
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+	if results == nil {
+		return []apiKey{}, nil
+	}
+	return results, nil
+}
+
+func revokeApiKey(userId primitive.ObjectID, keyId string) error {
+	id, err := primitive.ObjectIDFromHex(keyId)
+	if err != nil {
+		return err
+	}
+
+	result, err := getApiKeysColl().DeleteOne(context.TODO(), bson.M{"_id": id, "user": userId})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+/**
+ * Check an API key sent in the Authorization header
+ * @param key The plain API key
+ * @param clientIp The IP of the client, checked against the allowlist of the key
+ * @return The session of the key, and whether the key is valid
+ */
+func verifyApiKey(key string, clientIp string) (authSession, bool) {
+	var result apiKey
+	err := getApiKeysColl().FindOne(context.TODO(), bson.M{"keyHash": hashApiKey(key)}).Decode(&result)
+	if err != nil {
+		return authSession{}, false
+	}
+
+	now := time.Now()
+	if result.Expires != nil && now.After(*result.Expires) {
+		return authSession{}, false
+	}
+	if !checkIpAllowlist(clientIp, result.IpAllowlist) {
+		return authSession{}, false
+	}
+
+	_, _ = getApiKeysColl().UpdateOne(context.TODO(), bson.M{"_id": result.Id}, bson.M{
+		"$set": bson.M{"lastUsed": now},
+	})
+
+	return authSession{
+		userId:   result.UserId,
+		apiKeyId: result.Id,
+		scopes:   result.Scopes,
+	}, true
+}
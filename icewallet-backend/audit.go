@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audited actions
+const (
+	AuditCreateEntry    = "createEntry"
+	AuditUpdateEntry    = "updateEntry"
+	AuditDeleteEntry    = "deleteEntry"
+	AuditRestoreEntry   = "restoreEntry"
+	AuditUndoChange     = "undoChange"
+	AuditChangePassword = "changePassword"
+	AuditClearTokens    = "clearTokens"
+)
+
+// auditEvent is a record in the append-only audit log. Events are never updated or deleted
+type auditEvent struct {
+	Id     primitive.ObjectID `bson:"_id" json:"id"`
+	Action string             `bson:"action" json:"action"`
+	Route  string             `bson:"route" json:"route"`
+	// The actor is the user, and the session token or API key the request was made with
+	UserId   primitive.ObjectID  `bson:"user" json:"user"`
+	TokenId  *primitive.ObjectID `bson:"tokenId,omitempty" json:"tokenId,omitempty"`
+	ApiKeyId *primitive.ObjectID `bson:"apiKeyId,omitempty" json:"apiKeyId,omitempty"`
+	ClientIp string              `bson:"clientIp" json:"clientIp"`
+	Wallet   *primitive.ObjectID `bson:"wallet,omitempty" json:"wallet,omitempty"`
+	EntryId  *primitive.ObjectID `bson:"entryId,omitempty" json:"entryId,omitempty"`
+	Before   interface{}         `bson:"before" json:"before"`
+	After    interface{}         `bson:"after" json:"after"`
+	Time     time.Time           `bson:"time" json:"time"`
+}
+
+/**
+ * Append an event to the audit log. Failures are logged, since the change itself has already been made
+ * @param r The request making the change
+ * @param session The session of the request
+ * @param action One of the audited actions
+ * @param walletId The wallet of the changed entry, or nil for account changes
+ * @param entryId The changed entry, or nil for account changes
+ * @param before The document before the change, or nil
+ * @param after The document after the change, or nil
+ */
+func recordAuditEvent(r *http.Request, session authSession, action string, walletId *primitive.ObjectID, entryId *primitive.ObjectID, before interface{}, after interface{}) {
+	event := auditEvent{
+		Id:       primitive.NewObjectID(),
+		Action:   action,
+		Route:    r.URL.Path,
+		UserId:   session.userId,
+		ClientIp: getClientIp(r),
+		Wallet:   walletId,
+		EntryId:  entryId,
+		Before:   before,
+		After:    after,
+		Time:     time.Now(),
+	}
+	if session.isApiKey() {
+		event.ApiKeyId = &session.apiKeyId
+	} else {
+		event.TokenId = &session.tokenId
+	}
+
+	_, err := getAuditColl().InsertOne(context.TODO(), event)
+	if err != nil {
+		log.Println("Failed to record audit event:", err)
+	}
+}
+
+/**
+ * Find audit events, newest first
+ * @param query The query, by wallet or by user
+ * @param start The number of events to skip
+ * @param limit The maximum number of events to return
+ * @return The events, the total number of matching events, error
+ */
+func findAuditEvents(query bson.M, start int64, limit int64) ([]auditEvent, int64, error) {
+	count, err := getAuditColl().CountDocuments(context.TODO(), query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor, err := getAuditColl().Find(context.TODO(), query, options.Find().
+		SetSort(bson.M{"time": -1}).
+		SetSkip(start).
+		SetLimit(limit))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var results []auditEvent
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, 0, err
+	}
+	if results == nil {
+		results = []auditEvent{}
+	}
+	return results, count, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Bulk operations
+const (
+	BulkUpdate = "update"
+	BulkDelete = "delete"
+	BulkTag    = "tag"
+)
+
+// Statuses of the entries of a bulk operation
+const (
+	BulkStatusMatched  = "matched"
+	BulkStatusUpdated  = "updated"
+	BulkStatusDeleted  = "deleted"
+	BulkStatusNotFound = "notFound"
+	BulkStatusConflict = "conflict"
+	BulkStatusFailed   = "failed"
+)
+
+// The maximum number of entries a bulk operation can change
+const maxBulkEntries = 1000
+
+var errTooManyBulkEntries = errors.New("too many entries, at most 1000 can be changed at once")
+
+// bulkOperation describes a change applied to many entries
+type bulkOperation struct {
+	Operation string
+	// For update operations, the fields to set and clear, see parseEntryChanges
+	Changes bson.M
+	Cleared []string
+	// For tag operations
+	AddTags    []string
+	RemoveTags []string
+}
+
+// bulkItemResult is the outcome of a bulk operation for one entry
+type bulkItemResult struct {
+	Id      string `json:"id"`
+	Status  string `json:"status"`
+	Version int64  `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+	before  bson.M
+	after   bson.M
+}
+
+/**
+ * Find the entries a bulk operation applies to, by ids or by query
+ * @param walletId The wallet of the entries
+ * @param ids The entry ids, or nil to use the query
+ * @param query The query built by buildFilters, used if ids is nil
+ * @return The entries, the requested ids that were not found, error
+ */
+func findBulkTargets(ctx context.Context, walletId primitive.ObjectID, ids []string, query map[string]interface{}) ([]bson.M, []string, error) {
+	if ids != nil {
+		if len(ids) > maxBulkEntries {
+			return nil, nil, errTooManyBulkEntries
+		}
+		objectIds := make([]primitive.ObjectID, 0, len(ids))
+		for _, id := range ids {
+			objectId, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return nil, nil, errors.New("invalid entry id: " + id)
+			}
+			objectIds = append(objectIds, objectId)
+		}
+		query = bson.M{
+			"_id":       bson.M{"$in": objectIds},
+			"wallet":    walletId,
+			"deletedAt": bson.M{"$exists": false},
+		}
+	}
+
+	cursor, err := getEntriesColl().Find(ctx, query, options.Find().
+		SetSort(bson.M{"_id": 1}).
+		SetLimit(maxBulkEntries+1).
+		SetMaxTime(entryQueryTimeout))
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []bson.M
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, nil, err
+	}
+	if len(entries) > maxBulkEntries {
+		return nil, nil, errTooManyBulkEntries
+	}
+
+	var missing []string
+	if ids != nil {
+		found := make(map[string]bool)
+		for _, entry := range entries {
+			found[entry["_id"].(primitive.ObjectID).Hex()] = true
+		}
+		for _, id := range ids {
+			if !found[id] {
+				missing = append(missing, id)
+			}
+		}
+	}
+	return entries, missing, nil
+}
+
+// entryTags reads the tags of an entry document
+func entryTags(entry bson.M) []string {
+	tags := []string{}
+	if values, ok := entry["tags"].(primitive.A); ok {
+		for _, value := range values {
+			if tag, ok := value.(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// applyTagChanges adds and removes tags, keeping the order of existing tags
+func applyTagChanges(tags []string, add []string, remove []string) ([]string, error) {
+	removed := make(map[string]bool)
+	for _, tag := range remove {
+		removed[tag] = true
+	}
+
+	values := make([]interface{}, 0, len(tags)+len(add))
+	for _, tag := range tags {
+		if !removed[tag] {
+			values = append(values, tag)
+		}
+	}
+	for _, tag := range add {
+		values = append(values, tag)
+	}
+	return normalizeTags(values)
+}
+
+// applyBulkOperation applies the operation to one entry within the context
+func applyBulkOperation(ctx context.Context, walletId primitive.ObjectID, entry bson.M, op bulkOperation) bulkItemResult {
+	id := entry["_id"].(primitive.ObjectID)
+	version := entryVersion(entry)
+	result := bulkItemResult{Id: id.Hex()}
+
+	var before, after bson.M
+	var err error
+	switch op.Operation {
+	case BulkDelete:
+		before, after, err = trashEntry(ctx, walletId, id, version)
+		if err == nil && before == nil {
+			err = mongo.ErrNoDocuments
+		}
+	case BulkTag:
+		var tags []string
+		tags, err = applyTagChanges(entryTags(entry), op.AddTags, op.RemoveTags)
+		if err != nil {
+			break
+		}
+		if len(tags) == 0 {
+			before, after, err = changeEntry(ctx, walletId, id, version, bson.M{}, []string{"tags"})
+		} else {
+			before, after, err = changeEntry(ctx, walletId, id, version, bson.M{"tags": tags}, nil)
+		}
+	default:
+		before, after, err = changeEntry(ctx, walletId, id, version, op.Changes, op.Cleared)
+	}
+
+	switch {
+	case err == nil && op.Operation == BulkDelete:
+		result.Status = BulkStatusDeleted
+	case err == nil:
+		result.Status = BulkStatusUpdated
+	case err == errVersionConflict:
+		result.Status = BulkStatusConflict
+	case err == mongo.ErrNoDocuments:
+		result.Status = BulkStatusNotFound
+	default:
+		result.Status = BulkStatusFailed
+		result.Error = err.Error()
+	}
+	if err == nil {
+		result.Version = entryVersion(after)
+		result.before = before
+		result.after = after
+	}
+	return result
+}
+
+/**
+ * Apply an operation to many entries of a wallet. All changes are made in one transaction
+ * where the server supports it. Entries that changed concurrently are reported as conflicts
+ * @param walletId The wallet of the entries
+ * @param ids The entry ids, or nil to use the query
+ * @param query The query built by buildFilters, used if ids is nil
+ * @param op The operation
+ * @param dryRun Whether to only find the entries without changing them
+ * @return The result of each entry, error
+ */
+func runBulkOperation(walletId primitive.ObjectID, ids []string, query map[string]interface{}, op bulkOperation, dryRun bool) ([]bulkItemResult, error) {
+	var results []bulkItemResult
+	run := func(ctx context.Context) error {
+		// The function may be retried by the transaction, so results start over
+		results = []bulkItemResult{}
+		entries, missing, err := findBulkTargets(ctx, walletId, ids, query)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if dryRun {
+				results = append(results, bulkItemResult{
+					Id:      entry["_id"].(primitive.ObjectID).Hex(),
+					Status:  BulkStatusMatched,
+					Version: entryVersion(entry),
+				})
+				continue
+			}
+			results = append(results, applyBulkOperation(ctx, walletId, entry, op))
+		}
+		for _, id := range missing {
+			results = append(results, bulkItemResult{Id: id, Status: BulkStatusNotFound})
+		}
+		return nil
+	}
+
+	var err error
+	if dryRun {
+		err = run(context.TODO())
+	} else {
+		err = runTransaction(run)
+	}
+	return results, err
+}
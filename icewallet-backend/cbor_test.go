@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeCbor(t *testing.T) {
+	// Examples from RFC 8949 appendix A
+	tests := []struct {
+		name string
+		hex  string
+		want interface{}
+	}{
+		{name: "zero", hex: "00", want: uint64(0)},
+		{name: "small uint", hex: "17", want: uint64(23)},
+		{name: "uint8", hex: "1818", want: uint64(24)},
+		{name: "uint16", hex: "190100", want: uint64(256)},
+		{name: "uint32", hex: "1a000f4240", want: uint64(1000000)},
+		{name: "uint64", hex: "1b000000e8d4a51000", want: uint64(1000000000000)},
+		{name: "negative", hex: "20", want: int64(-1)},
+		{name: "negative uint8", hex: "3863", want: int64(-100)},
+		{name: "byte string", hex: "4401020304", want: []byte{1, 2, 3, 4}},
+		{name: "empty byte string", hex: "40", want: []byte{}},
+		{name: "text string", hex: "6449455446", want: "IETF"},
+		{name: "utf-8 text string", hex: "62c3bc", want: "ü"},
+		{name: "array", hex: "83010203", want: []interface{}{uint64(1), uint64(2), uint64(3)}},
+		{name: "nested array", hex: "8301820203820405", want: []interface{}{
+			uint64(1), []interface{}{uint64(2), uint64(3)}, []interface{}{uint64(4), uint64(5)},
+		}},
+		{name: "map", hex: "a201020304", want: map[interface{}]interface{}{uint64(1): uint64(2), uint64(3): uint64(4)}},
+		{name: "map with text and negative keys", hex: "a2616101200b", want: map[interface{}]interface{}{"a": uint64(1), int64(-1): uint64(11)}},
+		{name: "false", hex: "f4", want: false},
+		{name: "true", hex: "f5", want: true},
+		{name: "null", hex: "f6", want: nil},
+		{name: "float32", hex: "fa47c35000", want: float64(100000)},
+		{name: "float64", hex: "fb3ff199999999999a", want: 1.1},
+		{name: "tag", hex: "c11a514b67b0", want: uint64(1363896240)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(test.hex)
+			got, n, err := decodeCbor(data)
+			if err != nil {
+				t.Fatalf("decodeCbor() error = %v", err)
+			}
+			if n != len(data) {
+				t.Errorf("decodeCbor() consumed %d bytes, want %d", n, len(data))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("decodeCbor() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCborTrailingData(t *testing.T) {
+	// Only the first item is decoded, which is how COSE keys are read from authenticator data
+	got, n, err := decodeCbor([]byte{0x01, 0x02, 0x03})
+	if err != nil || got != uint64(1) || n != 1 {
+		t.Errorf("decodeCbor() = %v, %d, %v, want 1, 1, nil", got, n, err)
+	}
+}
+
+func TestDecodeCborInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+	}{
+		{name: "empty", hex: ""},
+		{name: "truncated uint8", hex: "18"},
+		{name: "truncated uint16", hex: "1901"},
+		{name: "truncated uint32", hex: "1a000f42"},
+		{name: "truncated uint64", hex: "1b000000e8d4a510"},
+		{name: "truncated byte string", hex: "440102"},
+		{name: "truncated text string", hex: "64494554"},
+		{name: "truncated array", hex: "830102"},
+		{name: "map without value", hex: "a101"},
+		{name: "truncated map", hex: "a2010203"},
+		{name: "reserved additional information", hex: "1c"},
+		{name: "indefinite length byte string", hex: "5f41014102ff"},
+		{name: "indefinite length array", hex: "9f0102ff"},
+		{name: "negative integer overflow", hex: "3b8000000000000000"},
+		{name: "byte string longer than data", hex: "5bffffffffffffffff00"},
+		{name: "array longer than data", hex: "9bffffffffffffffff"},
+		{name: "map longer than data", hex: "bbffffffffffffffff"},
+		{name: "byte string map key", hex: "a1410101"},
+		{name: "array map key", hex: "a1800101"},
+		{name: "unsupported simple value", hex: "f0"},
+		{name: "nesting too deep", hex: "818181818181818181818181818181818100"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := hex.DecodeString(test.hex)
+			if err != nil {
+				t.Fatalf("invalid test data: %v", err)
+			}
+			if got, _, err := decodeCbor(data); err == nil {
+				t.Errorf("decodeCbor() = %#v, want error", got)
+			}
+		})
+	}
+}
+
+func TestCborInt(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		want   int64
+		wantOk bool
+	}{
+		{value: uint64(3), want: 3, wantOk: true},
+		{value: int64(-7), want: -7, wantOk: true},
+		{value: uint64(1) << 63},
+		{value: "3"},
+		{value: []byte{3}},
+		{value: nil},
+	}
+	for _, test := range tests {
+		got, ok := cborInt(test.value)
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("cborInt(%#v) = %d, %v, want %d, %v", test.value, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestCborMapIntKey(t *testing.T) {
+	// Positive keys decode as uint64 and negative keys as int64
+	data, _ := hex.DecodeString("a301022620215820" + hex.EncodeToString(bytes.Repeat([]byte{0xab}, 32)))
+	decoded, _, err := decodeCbor(data)
+	if err != nil {
+		t.Fatalf("decodeCbor() error = %v", err)
+	}
+	m := decoded.(map[interface{}]interface{})
+	if got := cborMapIntKey(m, 1); got != uint64(2) {
+		t.Errorf("cborMapIntKey(1) = %#v, want 2", got)
+	}
+	if got := cborMapIntKey(m, -7); got != int64(-1) {
+		t.Errorf("cborMapIntKey(-7) = %#v, want -1", got)
+	}
+	if got, _ := cborMapIntKey(m, -2).([]byte); !bytes.Equal(got, bytes.Repeat([]byte{0xab}, 32)) {
+		t.Errorf("cborMapIntKey(-2) = %x", got)
+	}
+	if got := cborMapIntKey(m, 3); got != nil {
+		t.Errorf("cborMapIntKey(3) = %#v, want nil", got)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command line modes that manage users, mapped to their description.
+// These run after connecting to the database, and exit once done
+var cliModes = map[string]string{
+	"--adduser":      "add user",
+	"--deluser":      "remove user",
+	"--listusers":    "list users",
+	"--pwd":          "password reset",
+	"--disable-2fa":  "two-factor authentication reset",
+	"--addapikey":    "API key creation",
+	"--listapikeys":  "API key listing",
+	"--revokeapikey": "API key revocation",
+}
+
+func cliUsage() string {
+	return strings.Join([]string{
+		"Use --genkey to generate a key pair",
+		"Use --adduser to add a user",
+		"Use --deluser to remove a user and all of their data",
+		"Use --listusers to list users",
+		"Use --pwd to reset the password of a user",
+		"Use --disable-2fa to disable two-factor authentication of a user",
+		"Use --addapikey to create an API key for a user",
+		"Use --listapikeys to list the API keys of a user",
+		"Use --revokeapikey to revoke an API key of a user",
+	}, "\n")
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// prompt prints a message and reads a line from the standard input
+func prompt(message string) (string, error) {
+	log.Print(message)
+	line, err := stdinReader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// promptList asks for a comma separated list, returning an empty list for an empty line
+func promptList(message string) ([]string, error) {
+	line, err := prompt(message)
+	if err != nil {
+		return nil, err
+	}
+	items := []string{}
+	for _, item := range strings.Split(line, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// promptUser asks for a username and finds the user
+func promptUser() (walletUser, error) {
+	username, err := prompt("Username: ")
+	if err != nil {
+		return walletUser{}, err
+	}
+	user, err := findUserByName(username)
+	if err != nil {
+		return walletUser{}, errors.New("user " + username + " does not exist")
+	}
+	return user, nil
+}
+
+func runCliMode(mode string) error {
+	switch mode {
+	case "--adduser":
+		username, err := prompt("Username: ")
+		if err != nil {
+			return err
+		}
+		password, err := prompt("Password: ")
+		if err != nil {
+			return err
+		}
+		_, err = addUser(username, password)
+		if err != nil {
+			return err
+		}
+		log.Println("User " + normalizeUsername(username) + " added")
+		return nil
+
+	case "--deluser":
+		user, err := promptUser()
+		if err != nil {
+			return err
+		}
+		confirm, err := prompt("This deletes all entries of " + user.Username + ". Type the username again to confirm: ")
+		if err != nil {
+			return err
+		}
+		if normalizeUsername(confirm) != user.Username {
+			return errors.New("confirmation does not match, nothing was deleted")
+		}
+		err = removeUser(user.Username)
+		if err != nil {
+			return err
+		}
+		log.Println("User " + user.Username + " removed")
+		return nil
+
+	case "--listusers":
+		users, err := getUsers()
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Println(user.Username)
+		}
+		return nil
+
+	case "--pwd":
+		user, err := promptUser()
+		if err != nil {
+			return err
+		}
+		password, err := prompt("Provide a new password: ")
+		if err != nil {
+			return err
+		}
+		err = changePassword(user.Id, password)
+		if err != nil {
+			return err
+		}
+		log.Println("Password changed successfully")
+		return nil
+
+	case "--disable-2fa":
+		user, err := promptUser()
+		if err != nil {
+			return err
+		}
+		err = disableTotp(user.Id)
+		if err != nil {
+			return err
+		}
+		log.Println("Two-factor authentication disabled for " + user.Username)
+		return nil
+
+	case "--addapikey":
+		user, err := promptUser()
+		if err != nil {
+			return err
+		}
+		name, err := prompt("Key name: ")
+		if err != nil {
+			return err
+		}
+		scopes, err := promptList("Scopes, comma separated (read-entries, write-entries, reports-only): ")
+		if err != nil {
+			return err
+		}
+		days, err := prompt("Days until the key expires, empty for never: ")
+		if err != nil {
+			return err
+		}
+		var expires *time.Time
+		if strings.TrimSpace(days) != "" {
+			n, err := strconv.Atoi(strings.TrimSpace(days))
+			if err != nil || n <= 0 {
+				return errors.New("invalid number of days")
+			}
+			t := time.Now().AddDate(0, 0, n)
+			expires = &t
+		}
+		ipAllowlist, err := promptList("Allowed IPs or CIDR ranges, comma separated, empty for any: ")
+		if err != nil {
+			return err
+		}
+		key, plainKey, err := createApiKey(user.Id, name, scopes, expires, ipAllowlist)
+		if err != nil {
+			return err
+		}
+		log.Println("API key " + key.Id.Hex() + " created. It will not be shown again:")
+		fmt.Println(plainKey)
+		return nil
+
+	case "--listapikeys":
+		user, err := promptUser()
+		if err != nil {
+			return err
+		}
+		keys, err := getApiKeys(user.Id)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			expires := "never"
+			if key.Expires != nil {
+				expires = key.Expires.Format(time.RFC3339)
+			}
+			fmt.Println(key.Id.Hex(), key.Hint, key.Name, "scopes:", strings.Join(key.Scopes, ","), "expires:", expires)
+		}
+		return nil
+
+	case "--revokeapikey":
+		user, err := promptUser()
+		if err != nil {
+			return err
+		}
+		keyId, err := prompt("Key id: ")
+		if err != nil {
+			return err
+		}
+		err = revokeApiKey(user.Id, strings.TrimSpace(keyId))
+		if err != nil {
+			return errors.New("API key not found")
+		}
+		log.Println("API key revoked")
+		return nil
+
+	default:
+		return errors.New(cliUsage())
+	}
+}
@@ -5,10 +5,14 @@ import (
 
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"math/big"
+	"net/http"
 	mathRnd "math/rand"
 	"os"
 	"reflect"
@@ -16,14 +20,28 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
-	"golang.org/x/crypto/bcrypt"
+// Password transport schemes accepted by /login and /changePassword
+const (
+	passwordSchemeOAEP   = "rsa-oaep-sha256"
+	passwordSchemeLegacy = "rsa-pkcs1v15"
 )
 
 var publicKeyStr string
 var publicKey *rsa.PublicKey
 var privateKey *rsa.PrivateKey
 
+// Nonces handed out by /getLoginNonce. Each nonce can be used by one request only
+var loginNonces = newExpiringStore(2 * time.Minute)
+
+// sealedPassword is the plaintext of an RSA-OAEP encrypted password
+type sealedPassword struct {
+	Password string `json:"password"`
+	Nonce    string `json:"nonce"`
+}
+
 func getRandomHash() string {
 	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 	mathRnd.Seed(time.Now().UnixNano())
@@ -34,11 +52,27 @@ func getRandomHash() string {
 	return string(b)
 }
 
-func generateToken() (string, error) {
+// generateSecureRandomString returns a random alphanumeric string of the given length,
+// using a cryptographically secure source
+func generateSecureRandomString(length int) (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = letters[n.Int64()]
+	}
+	return string(b), nil
+}
+
+func generateToken(userId primitive.ObjectID) (string, error) {
 	// Insert token into database
 	token := getRandomHash()
 	_, err := getTokensColl().InsertOne(context.TODO(), map[string]interface{}{
 		"token": token,
+		"user":  userId,
 	})
 	if err != nil {
 		return "", err
@@ -75,24 +109,28 @@ func generateKeyPair() (string, string, error) {
 }
 
 func verifyKeyPair() bool {
-	// Generate random password
+	// Generate random password and nonce
 	password := getRandomHash()
+	nonce := getRandomHash()
 
 	// Encrypt password
-	encryptedBytes, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, []byte(password))
+	plaintext, err := json.Marshal(sealedPassword{Password: password, Nonce: nonce})
+	if err != nil {
+		return false
+	}
+	encryptedBytes, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, plaintext, nil)
 	if err != nil {
 		return false
 	}
 
 	// Decrypt password
-	var decryptedChallenge string
-	decryptedChallenge, err = decryptPassword(base64.StdEncoding.EncodeToString(encryptedBytes))
+	decrypted, err := openSealedPassword(base64.StdEncoding.EncodeToString(encryptedBytes))
 	if err != nil {
 		return false
 	}
 
 	// Verify password
-	return decryptedChallenge == password
+	return decrypted.Password == password && decrypted.Nonce == nonce
 }
 
 func initRSAkeys() error {
@@ -120,11 +158,21 @@ func initRSAkeys() error {
 	return err
 }
 
+// isLegacyPasswordTransportEnabled reports whether clients may still send passwords
+// encrypted with RSA-PKCS1v15 and no nonce. Controlled by LEGACY_PASSWORD_TRANSPORT
+func isLegacyPasswordTransportEnabled() bool {
+	return os.Getenv("LEGACY_PASSWORD_TRANSPORT") == "true"
+}
+
+// decryptPassword decrypts a password sent with the legacy RSA-PKCS1v15 scheme
 func decryptPassword(password string) (string, error) {
 	// Decrypt password
 	var decryptedBytes []byte
 
 	challengeBytes, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return "", err
+	}
 	decryptedBytes, err = rsa.DecryptPKCS1v15(rand.Reader, privateKey, challengeBytes)
 	if err != nil {
 		return "", err
@@ -132,66 +180,154 @@ func decryptPassword(password string) (string, error) {
 	return string(decryptedBytes), nil
 }
 
-func verifyToken(token string) bool {
-	// Check if token exists in database
-	var result bson.M
-	err := getTokensColl().FindOne(context.TODO(), bson.D{{"token", token}}).Decode(&result)
+// openSealedPassword decrypts an RSA-OAEP (SHA-256) encrypted {password, nonce} JSON payload.
+// The nonce is returned as is, it is up to the caller to consume it
+func openSealedPassword(sealed string) (sealedPassword, error) {
+	var result sealedPassword
+
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed)
 	if err != nil {
-		return false
+		return result, err
 	}
+	plaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, ciphertext, nil)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(plaintext, &result)
+	if err != nil {
+		return result, err
+	}
+	if result.Nonce == "" {
+		return result, errors.New("missing nonce")
+	}
+	return result, nil
+}
 
-	return reflect.TypeOf(result["token"]).String() == "string" && result["token"].(string) == token
+// generateLoginNonce creates a single-use nonce that must be sealed together with
+// the password by the client. Returns the nonce and its expiry time
+func generateLoginNonce() (string, time.Time, error) {
+	nonce, err := generateSecureRandomString(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := loginNonces.put(nonce, true)
+	return nonce, expires, nil
 }
 
-func deleteToken(token string) error {
-	_, err := getTokensColl().DeleteOne(context.TODO(), bson.D{{"token", token}})
-	return err
+// unsealPasswords decrypts the given password fields of a request body.
+// With the RSA-OAEP scheme, every field must carry the same nonce, which is consumed
+// so that a captured request cannot be replayed. The legacy scheme is only accepted
+// when enabled through LEGACY_PASSWORD_TRANSPORT
+func unsealPasswords(body map[string]interface{}, fields []string) ([]string, error) {
+	scheme := passwordSchemeLegacy
+	if s, ok := body["scheme"].(string); ok {
+		scheme = s
+	}
+
+	passwords := make([]string, len(fields))
+	switch scheme {
+	case passwordSchemeOAEP:
+		var nonce string
+		for i, field := range fields {
+			sealed, err := openSealedPassword(body[field].(string))
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 && sealed.Nonce != nonce {
+				return nil, errors.New("nonce mismatch")
+			}
+			nonce = sealed.Nonce
+			passwords[i] = sealed.Password
+		}
+		if _, ok := loginNonces.take(nonce); !ok {
+			return nil, errors.New("invalid or expired nonce")
+		}
+	case passwordSchemeLegacy:
+		if !isLegacyPasswordTransportEnabled() {
+			return nil, errors.New("legacy password transport is disabled")
+		}
+		for i, field := range fields {
+			password, err := decryptPassword(body[field].(string))
+			if err != nil {
+				return nil, err
+			}
+			passwords[i] = password
+		}
+	default:
+		return nil, errors.New("unsupported password scheme")
+	}
+
+	return passwords, nil
 }
 
-func deleteAllTokens() error {
-	_, err := getTokensColl().DeleteMany(context.TODO(), bson.D{})
-	return err
+// authSession identifies the user behind an authenticated request
+type authSession struct {
+	userId  primitive.ObjectID
+	token   string
+	tokenId primitive.ObjectID
+	// Set when authenticated with an API key instead of a session token
+	apiKeyId primitive.ObjectID
+	scopes   []string
 }
 
-func checkPasswordExists() bool {
-	var result bson.M
-	err := getMetaColl().FindOne(context.TODO(), bson.D{{"type", "password"}}).Decode(&result)
-	return err == nil
+func (s authSession) isApiKey() bool {
+	return s.apiKeyId != primitive.NilObjectID
 }
 
-func changePassword(password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return err
+// hasScope checks whether the session grants the scope. Session tokens grant every scope,
+// and the read-entries scope includes reports
+func (s authSession) hasScope(scope string) bool {
+	if !s.isApiKey() {
+		return true
 	}
-
-	if checkPasswordExists() {
-		_, err = getMetaColl().UpdateOne(context.TODO(), bson.D{{"type", "password"}}, bson.D{
-			{
-				"$set", bson.D{
-					{"password", string(hashedPassword)},
-				},
-			},
-		})
-	} else {
-		_, err = getMetaColl().InsertOne(context.TODO(), map[string]interface{}{
-			"type":     "password",
-			"password": string(hashedPassword),
-		})
+	for _, granted := range s.scopes {
+		if granted == scope || (scope == ScopeReportsOnly && granted == ScopeReadEntries) {
+			return true
+		}
 	}
+	return false
+}
 
-	return err
+/**
+ * Authenticate a request by the session token or API key in its Authorization header
+ * @return The session, and whether the token or key is valid
+ */
+func authenticateRequest(r *http.Request) (authSession, bool) {
+	credential := r.Header.Get("Authorization")
+	if strings.HasPrefix(credential, apiKeyPrefix) {
+		return verifyApiKey(credential, getClientIp(r))
+	}
+	return verifyToken(credential)
 }
 
-func verifyPassword(password string) bool {
-	// Find the password document
+/**
+ * Check if a token exists and find the user it belongs to
+ * @param token The token sent in the Authorization header
+ * @return The session of the token, and whether the token is valid
+ */
+func verifyToken(token string) (authSession, bool) {
+	// Check if token exists in database
 	var result bson.M
-	err := getMetaColl().FindOne(context.TODO(), bson.D{{"type", "password"}}).Decode(&result)
+	err := getTokensColl().FindOne(context.TODO(), bson.M{"token": token}).Decode(&result)
 	if err != nil {
-		return false
+		return authSession{}, false
 	}
 
-	// Compare password
-	err = bcrypt.CompareHashAndPassword([]byte(result["password"].(string)), []byte(password))
-	return err == nil
+	userId, ok := result["user"].(primitive.ObjectID)
+	if !ok || reflect.TypeOf(result["token"]).String() != "string" || result["token"].(string) != token {
+		return authSession{}, false
+	}
+	tokenId, _ := result["_id"].(primitive.ObjectID)
+	return authSession{userId: userId, token: token, tokenId: tokenId}, true
+}
+
+func deleteToken(token string) error {
+	_, err := getTokensColl().DeleteOne(context.TODO(), bson.M{"token": token})
+	return err
+}
+
+// deleteAllTokens deletes every token of the user
+func deleteAllTokens(userId primitive.ObjectID) error {
+	_, err := getTokensColl().DeleteMany(context.TODO(), bson.M{"user": userId})
+	return err
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -11,6 +12,14 @@ var mongoClient *mongo.Client
 var entriesColl *mongo.Collection
 var tokensColl	*mongo.Collection
 var metaColl 	*mongo.Collection
+var usersColl	*mongo.Collection
+var walletsColl	*mongo.Collection
+var apiKeysColl	*mongo.Collection
+var auditColl	*mongo.Collection
+var revisionsColl	*mongo.Collection
+
+// Whether the server is a replica set or sharded cluster, which support transactions
+var transactionsSupported bool
 
 func connectDB(uri string, dbName string) error {
 	var err error
@@ -29,7 +38,133 @@ func connectDB(uri string, dbName string) error {
 	entriesColl = db.Collection("entries")
 	tokensColl = db.Collection("tokens")
 	metaColl = db.Collection("meta")
-	return nil
+	usersColl = db.Collection("users")
+	walletsColl = db.Collection("wallets")
+	apiKeysColl = db.Collection("apiKeys")
+	auditColl = db.Collection("auditLog")
+	revisionsColl = db.Collection("revisions")
+
+	var hello bson.M
+	err = mongoClient.Database("admin").RunCommand(context.TODO(), bson.M{"isMaster": 1}).Decode(&hello)
+	if err != nil {
+		return err
+	}
+	transactionsSupported = hello["setName"] != nil || hello["msg"] == "isdbgrid"
+	return createIndexes()
+}
+
+// createIndexes creates the indexes used by queries. Existing indexes are left untouched
+func createIndexes() error {
+	_, err := usersColl.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tokensColl.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "token", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Indexes for the common sorts of entries, see parseEntrySort. Each index also serves the reverse order
+	_, err = entriesColl.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "wallet", Value: 1}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "wallet", Value: 1}, {Key: "amount", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "wallet", Value: 1}, {Key: "createTime", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "wallet", Value: 1}, {Key: "date", Value: -1}, {Key: "amount", Value: 1}, {Key: "_id", Value: 1}}},
+		// Text index for searches, see addSearchToQuery. Searches always match a wallet, which prefixes the index
+		{
+			Keys:    bson.D{{Key: "wallet", Value: 1}, {Key: "description", Value: "text"}, {Key: "notes", Value: "text"}},
+			Options: options.Index().SetName("entries_text"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = walletsColl.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "members.user", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = walletsColl.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "personalOf", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apiKeysColl.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "keyHash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = entriesColl.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "deletedAt", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = revisionsColl.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "entry", Value: 1}, {Key: "revision", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "wallet", Value: 1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Credential ids identify passkeys at login, so each can only be registered once
+	_, err = metaColl.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "credentialId", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"type": "passkey"}),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = auditColl.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "wallet", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "user", Value: 1}, {Key: "time", Value: -1}}},
+	})
+	return err
+}
+
+/**
+ * Run a function in a transaction, so that its changes are applied all or nothing.
+ * Standalone servers do not support transactions, in which case the function runs without one
+ * @param fn The function, which must use the given context for all database operations
+ */
+func runTransaction(fn func(ctx context.Context) error) error {
+	if !transactionsSupported {
+		return fn(context.TODO())
+	}
+
+	session, err := mongoClient.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.TODO())
+
+	_, err = session.WithTransaction(context.TODO(), func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
 }
 
 func disconnectDB() error {
@@ -47,3 +182,23 @@ func getTokensColl() *mongo.Collection {
 func getMetaColl() *mongo.Collection {
 	return metaColl
 }
+
+func getUsersColl() *mongo.Collection {
+	return usersColl
+}
+
+func getWalletsColl() *mongo.Collection {
+	return walletsColl
+}
+
+func getApiKeysColl() *mongo.Collection {
+	return apiKeysColl
+}
+
+func getAuditColl() *mongo.Collection {
+	return auditColl
+}
+
+func getRevisionsColl() *mongo.Collection {
+	return revisionsColl
+}
\ No newline at end of file
@@ -8,6 +8,7 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -27,42 +28,138 @@ const (
 	Neq         = 5
 	Contains    = 6
 	NotContains = 7
+	StartsWith  = 8
+	EndsWith    = 9
+	// Case-insensitive exact match
+	EqualsIgnoreCase = 10
+	// Matches any value of a list
+	In = 11
+	// Matches a user-supplied regular expression, see validateUserRegex
+	Regex = 12
 )
 
+// String operators only apply to descriptions
+var stringFilterOps = map[int]bool{
+	Contains:         true,
+	NotContains:      true,
+	StartsWith:       true,
+	EndsWith:         true,
+	EqualsIgnoreCase: true,
+	Regex:            true,
+}
+
+// The maximum number of values of an In filter
+const maxInFilterValues = 100
+
 type walletEntry struct {
-	Description string    `bson:"description" json:"description"`
-	Amount      float64   `bson:"amount" json:"amount"`
-	Date        time.Time `bson:"date" json:"date"`
-	CreateTime  time.Time `bson:"createTime" json:"createTime"`
+	Id          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	Wallet      primitive.ObjectID `bson:"wallet" json:"wallet"`
+	Owner       primitive.ObjectID `bson:"owner" json:"owner"`
+	Description string             `bson:"description" json:"description"`
+	Amount      float64            `bson:"amount" json:"amount"`
+	Date        time.Time          `bson:"date" json:"date"`
+	Category    string             `bson:"category,omitempty" json:"category,omitempty"`
+	Tags        []string           `bson:"tags,omitempty" json:"tags,omitempty"`
+	Notes       string             `bson:"notes,omitempty" json:"notes,omitempty"`
+	CreateTime  time.Time          `bson:"createTime" json:"createTime"`
+	DeletedAt   *time.Time         `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	// Incremented on every change, so that changes based on an outdated copy can be rejected
+	Version int64 `bson:"version" json:"version"`
 }
 
+var errVersionConflict = errors.New("entry was changed since the given version")
+
 type entryFilter struct {
 	filterType      int
 	filterOp        int
 	filterFloatVal  float64
 	filterStringVal string
 	filterTimeVal   time.Time
+	// The end of a relative period such as "last-month", zero for other dates
+	filterTimeEnd time.Time
+	filterListVal []interface{}
 }
 
-func insertEntry(description string, amount float64, date string) error {
-	// Parse time from date string
-	t, err := time.Parse(time.RFC3339, date)
-	if err != nil {
-		return err
+// parseFilterList reads the values of an In filter, which must all be strings or all be numbers
+func parseFilterList(values []interface{}, typeName string) ([]interface{}, error) {
+	if len(values) == 0 || len(values) > maxInFilterValues {
+		return nil, errors.New("invalid number of filter values")
+	}
+	for _, value := range values {
+		if value == nil || reflect.TypeOf(value).String() != typeName {
+			return nil, errors.New("invalid filter value in list")
+		}
+	}
+	return values, nil
+}
+
+// validateFilterOp checks that the operator applies to the filter type
+func validateFilterOp(filter entryFilter) error {
+	if filter.filterOp < Lt || filter.filterOp > Regex {
+		return errors.New("invalid filter op")
+	}
+	if stringFilterOps[filter.filterOp] && filter.filterType != Description {
+		return errors.New("string filter ops only apply to descriptions")
+	}
+	if (filter.filterOp == In) != (filter.filterListVal != nil) {
+		return errors.New("only the In filter op takes a list")
+	}
+	if filter.filterOp == Regex {
+		return validateUserRegex(filter.filterStringVal)
+	}
+	return nil
+}
+
+/**
+ * Insert an entry into a wallet
+ * @param walletId The wallet of the entry
+ * @param owner The user creating the entry
+ * @param fields The entry fields, validated by parseEntryChanges
+ * @return The inserted entry, error
+ */
+func insertEntry(walletId primitive.ObjectID, owner primitive.ObjectID, fields bson.M) (walletEntry, error) {
+	for _, field := range requiredEntryFields {
+		if fields[field] == nil {
+			return walletEntry{}, errors.New(field + " is required")
+		}
 	}
 
-	_, err = getEntriesColl().InsertOne(context.TODO(), walletEntry{
-		Description: description,
-		Amount:      amount,
-		Date:        t,
+	entry := walletEntry{
+		Id:          primitive.NewObjectID(),
+		Wallet:      walletId,
+		Owner:       owner,
+		Description: fields["description"].(string),
+		Amount:      fields["amount"].(float64),
+		Date:        fields["date"].(time.Time),
 		CreateTime:  time.Now(),
-	})
-	return err
+		Version:     1,
+	}
+	if category, ok := fields["category"].(string); ok {
+		entry.Category = category
+	}
+	if tags, ok := fields["tags"].([]string); ok {
+		entry.Tags = tags
+	}
+	if notes, ok := fields["notes"].(string); ok {
+		entry.Notes = notes
+	}
+	_, err := getEntriesColl().InsertOne(context.TODO(), entry)
+	if err != nil {
+		return walletEntry{}, err
+	}
+	return entry, nil
 }
 
 func parseFiltersFromHttpBody(jsonBody map[string]interface{}) ([]entryFilter, error) {
 	var filters []entryFilter
 
+	// Relative dates are resolved in the timezone of the request
+	location, err := parseTimezone(jsonBody["timezone"])
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().In(location)
+
 	for _, filter := range jsonBody["filter"].([]interface{}) {
 		if reflect.TypeOf(filter).String() == "map[string]interface {}" {
 			if checkBodyFields(filter.(map[string]interface{}), []string{"type", "operator"}, []string{"float64", "float64"}) {
@@ -72,14 +169,16 @@ func parseFiltersFromHttpBody(jsonBody map[string]interface{}) ([]entryFilter, e
 					filterType := int(filter.(map[string]interface{})["type"].(float64))
 
 					if (filterType == Date || filterType == EntryDate) && valType == "string" {
-						parsedTime, err := time.Parse(time.RFC3339, val.(string))
+						// Dates are either RFC3339 or relative to now, such as "now-30d" or "last-month"
+						dates, err := parseDateValue(val.(string), now)
 						if err != nil {
 							return nil, err
 						}
 						filters = append(filters, entryFilter{
 							filterType:    filterType,
 							filterOp:      int(filter.(map[string]interface{})["operator"].(float64)),
-							filterTimeVal: parsedTime,
+							filterTimeVal: dates.Start,
+							filterTimeEnd: dates.End,
 						})
 					} else if filterType == Amount && valType == "float64" {
 						filters = append(filters, entryFilter{
@@ -93,6 +192,20 @@ func parseFiltersFromHttpBody(jsonBody map[string]interface{}) ([]entryFilter, e
 							filterOp:        int(filter.(map[string]interface{})["operator"].(float64)),
 							filterStringVal: val.(string),
 						})
+					} else if (filterType == Description || filterType == Amount) && valType == "[]interface {}" {
+						typeName := "string"
+						if filterType == Amount {
+							typeName = "float64"
+						}
+						list, err := parseFilterList(val.([]interface{}), typeName)
+						if err != nil {
+							return nil, err
+						}
+						filters = append(filters, entryFilter{
+							filterType:    filterType,
+							filterOp:      int(filter.(map[string]interface{})["operator"].(float64)),
+							filterListVal: list,
+						})
 					} else {
 						return nil, errors.New("invalid filter type and value combination")
 					}
@@ -107,19 +220,27 @@ func parseFiltersFromHttpBody(jsonBody map[string]interface{}) ([]entryFilter, e
 		}
 	}
 
+	for _, filter := range filters {
+		if err := validateFilterOp(filter); err != nil {
+			return nil, err
+		}
+	}
 	return filters, nil
 }
 
-func buildFilters(filters []entryFilter) (map[string]interface{}, error) {
+// buildFilters builds the query matching the entries of the wallet that pass all filters
+func buildFilters(walletId primitive.ObjectID, filters []entryFilter) (map[string]interface{}, error) {
+	query := make(map[string]interface{})
+	query["wallet"] = walletId
+	query["deletedAt"] = bson.M{"$exists": false}
 	if len(filters) == 0 {
-		return nil, nil
+		return query, nil
 	}
 
-	query := make(map[string]interface{})
 	query["$and"] = make([]map[string]interface{}, 0)
 
 	for _, filter := range filters {
-		var filterType, filterOp string
+		var filterType string
 		var filterVal interface{}
 
 		switch filter.filterType {
@@ -139,80 +260,142 @@ func buildFilters(filters []entryFilter) (map[string]interface{}, error) {
 			return nil, errors.New("invalid filter type")
 		}
 
+		// Relative periods such as "last-month" compare as a whole
+		if period := (dateRange{Start: filter.filterTimeVal, End: filter.filterTimeEnd}); period.isPeriod() {
+			condition, err := buildPeriodCondition(filter.filterOp, period)
+			if err != nil {
+				return nil, err
+			}
+			query["$and"] = append(query["$and"].([]map[string]interface{}), map[string]interface{}{filterType: condition})
+			continue
+		}
+
+		// String values match literally, except for the Regex op
+		var condition interface{}
 		switch filter.filterOp {
 		case Lt:
-			filterOp = "$lt"
+			condition = bson.M{"$lt": filterVal}
 		case Leq:
-			filterOp = "$lte"
+			condition = bson.M{"$lte": filterVal}
 		case Gt:
-			filterOp = "$gt"
+			condition = bson.M{"$gt": filterVal}
 		case Geq:
-			filterOp = "$gte"
+			condition = bson.M{"$gte": filterVal}
 		case Eq:
-			filterOp = "$eq"
+			condition = bson.M{"$eq": filterVal}
 		case Neq:
-			filterOp = "$ne"
+			condition = bson.M{"$ne": filterVal}
 		case Contains:
-			filterOp = "$regex"
-			filterVal = ".*" + filterVal.(string) + ".*"
+			condition = bson.M{"$regex": escapeRegex(filter.filterStringVal), "$options": "i"}
 		case NotContains:
-			filterOp = "$regex"
-			filterVal = "^(?!" + filterVal.(string) + ").*$"
+			condition = bson.M{"$not": primitive.Regex{Pattern: escapeRegex(filter.filterStringVal), Options: "i"}}
+		case StartsWith:
+			condition = bson.M{"$regex": "^" + escapeRegex(filter.filterStringVal), "$options": "i"}
+		case EndsWith:
+			condition = bson.M{"$regex": escapeRegex(filter.filterStringVal) + "$", "$options": "i"}
+		case EqualsIgnoreCase:
+			condition = bson.M{"$regex": "^" + escapeRegex(filter.filterStringVal) + "$", "$options": "i"}
+		case In:
+			condition = bson.M{"$in": filter.filterListVal}
+		case Regex:
+			condition = bson.M{"$regex": filter.filterStringVal}
 		default:
 			return nil, errors.New("invalid filter op")
 		}
 
-		filterQuery := make(map[string]interface{})
-		filterQuery[filterType] = make(map[string]interface{})
-		if filterOp == "$regex" {
-			filterQuery[filterType].(map[string]interface{})["$regex"] = filterVal
-			filterQuery[filterType].(map[string]interface{})["$options"] = "i"
-		} else {
-			filterQuery[filterType].(map[string]interface{})[filterOp] = filterVal
-		}
+		filterQuery := map[string]interface{}{filterType: condition}
 		query["$and"] = append(query["$and"].([]map[string]interface{}), filterQuery)
 	}
 
 	return query, nil
 }
 
-func findEntries(query map[string]interface{}, start int64, limit int64, sort string) ([]bson.M, error) {
-	// Get sort field
-	var sortField string
-	switch sort {
-	case "date":
-		sortField = "date"
-	case "amount":
-		sortField = "amount"
-	case "desc":
-		sortField = "description"
-	case "entryDate":
-		sortField = "createTime"
-	default:
-		sortField = "date"
+// entryPage is a page of entries, with cursors to the pages before and after it.
+// A cursor is empty if there is no such page
+type entryPage struct {
+	Entries    []bson.M
+	NextCursor string
+	PrevCursor string
+}
+
+/**
+ * Find a page of entries
+ * @param query The query built by buildFilters
+ * @param start The number of entries to skip, only used without a cursor
+ * @param limit The maximum number of entries to return
+ * @param sort The order of the entries
+ * @param cursorStr A cursor of a previous page, or empty for the page at start.
+ *	Sorts by relevance have no cursors, since relevance cannot be compared in queries
+ * @return The page, error (errInvalidCursor if the cursor is invalid or belongs to another sort)
+ */
+func findEntries(query map[string]interface{}, start int64, limit int64, sort entrySort, cursorStr string) (entryPage, error) {
+	findOptions := options.Find().SetLimit(limit + 1).SetMaxTime(entryQueryTimeout)
+	backward := false
+	if cursorStr != "" {
+		cursor, err := decodeCursor(sort, cursorStr)
+		if err != nil {
+			return entryPage{}, err
+		}
+		backward = cursor.Backward
+		query = bson.M{"$and": []interface{}{query, buildKeysetQuery(sort, cursor)}}
+	} else {
+		findOptions.SetSkip(start)
+	}
+	findOptions.SetSort(sort.bsonSort(backward))
+	if sort.byRelevance() {
+		findOptions.SetProjection(bson.M{relevanceField: bson.M{"$meta": "textScore"}})
 	}
 
 	// Execute query
-	cursor, err := getEntriesColl().Find(context.TODO(), query, &options.FindOptions{
-		Skip:  &start,
-		Limit: &limit,
-		Sort:  map[string]interface{}{sortField: -1},
-	})
+	cursor, err := getEntriesColl().Find(context.TODO(), query, findOptions)
 	if err != nil {
-		return nil, err
+		return entryPage{}, err
 	}
 
 	// Parse results
 	var results []bson.M
 	if err = cursor.All(context.Background(), &results); err != nil {
-		return nil, err
+		return entryPage{}, err
 	}
 
+	// One more entry than the limit is fetched to tell whether there are more entries
+	hasMore := int64(len(results)) > limit
+	if hasMore {
+		results = results[:limit]
+	}
+	if backward {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
 	if len(results) == 0 {
-		return []bson.M{}, nil
-	} else {
-		return results, nil
+		return entryPage{Entries: []bson.M{}}, nil
 	}
+	// Relevance scores are not stable keys, so relevance sorts are paged by offset only
+	page := entryPage{Entries: results}
+	if sort.byRelevance() {
+		return page, nil
+	}
+
+	// Going forward there are entries before unless this is the first page, and going backward
+	// there are entries after, since the cursor came from there
+	hasNext, hasPrev := hasMore, cursorStr != "" || start > 0
+	if backward {
+		hasNext, hasPrev = true, hasMore
+	}
+	if hasNext {
+		page.NextCursor, err = encodeCursor(sort, results[len(results)-1], false)
+		if err != nil {
+			return entryPage{}, err
+		}
+	}
+	if hasPrev {
+		page.PrevCursor, err = encodeCursor(sort, results[0], true)
+		if err != nil {
+			return entryPage{}, err
+		}
+	}
+	return page, nil
 }
 
 /**
@@ -261,7 +444,7 @@ func sumAndCountEntries(query map[string]interface{}) (bson.M, error) {
 		}
 	}
 
-	cursor, err := getEntriesColl().Aggregate(context.TODO(), pipeline)
+	cursor, err := getEntriesColl().Aggregate(context.TODO(), pipeline, options.Aggregate().SetMaxTime(entryQueryTimeout))
 	if err != nil {
 		return nil, err
 	}
@@ -282,39 +465,154 @@ func sumAndCountEntries(query map[string]interface{}) (bson.M, error) {
 	}
 }
 
-func deleteEntries(entryId string) error {
+// findEntry returns an entry of the wallet that is not in the trash
+func findEntry(walletId primitive.ObjectID, entryId string) (bson.M, error) {
 	id, err := primitive.ObjectIDFromHex(entryId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = getEntriesColl().DeleteMany(context.TODO(), bson.M{"_id": id})
-	return err
+	var result bson.M
+	err = getEntriesColl().FindOne(context.TODO(), bson.M{
+		"_id":       id,
+		"wallet":    walletId,
+		"deletedAt": bson.M{"$exists": false},
+	}).Decode(&result)
+	return result, err
 }
 
-func updateEntry(entryId string, description string, amount float64, date string) error {
-	id, err := primitive.ObjectIDFromHex(entryId)
+// entryVersion reads the version of an entry document
+func entryVersion(entry bson.M) int64 {
+	switch v := entry["version"].(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	default:
+		return 0
+	}
+}
+
+// versionMismatch is called when a change with an expected version matched no entry. It returns
+// errVersionConflict if the entry exists with another version, or mongo.ErrNoDocuments if not
+func versionMismatch(ctx context.Context, walletId primitive.ObjectID, id primitive.ObjectID) error {
+	count, err := getEntriesColl().CountDocuments(ctx, bson.M{
+		"_id":       id,
+		"wallet":    walletId,
+		"deletedAt": bson.M{"$exists": false},
+	})
 	if err != nil {
 		return err
 	}
+	if count > 0 {
+		return errVersionConflict
+	}
+	return mongo.ErrNoDocuments
+}
 
-	// Parse time from date string
-	var t time.Time
-	t, err = time.Parse(time.RFC3339, date)
+/**
+ * Move an entry to the trash. Trashed entries are purged after the retention period, see purgeTrash
+ * @param version The version of the entry the change is based on
+ * @return The entry before and after trashing, both nil if the entry does not exist,
+ *	error (errVersionConflict if the entry has another version)
+ */
+func deleteEntries(walletId primitive.ObjectID, entryId string, version int64) (bson.M, bson.M, error) {
+	id, err := primitive.ObjectIDFromHex(entryId)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	return trashEntry(context.TODO(), walletId, id, version)
+}
 
-	_, err = getEntriesColl().UpdateOne(context.TODO(), bson.D{
-		{"_id", id},
-	}, bson.D{
-		{"$set", bson.D{
-			{"description", description},
-			{"amount", amount},
-			{"date", t},
-		}},
-	})
-	return err
+// trashEntry moves an entry to the trash within the context, which may be a transaction. See deleteEntries
+func trashEntry(ctx context.Context, walletId primitive.ObjectID, id primitive.ObjectID, version int64) (bson.M, bson.M, error) {
+	deletedAt := time.Now()
+	var before bson.M
+	err := getEntriesColl().FindOneAndUpdate(ctx, bson.M{
+		"_id":       id,
+		"wallet":    walletId,
+		"deletedAt": bson.M{"$exists": false},
+		"version":   version,
+	}, bson.M{
+		"$set": bson.M{"deletedAt": deletedAt},
+		"$inc": bson.M{"version": 1},
+	}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		err = versionMismatch(ctx, walletId, id)
+		if err == mongo.ErrNoDocuments {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	after := bson.M{}
+	for key, value := range before {
+		after[key] = value
+	}
+	after["deletedAt"] = deletedAt
+	after["version"] = version + 1
+	return before, after, nil
+}
+
+/**
+ * Update some fields of an entry, leaving the other fields unchanged
+ * @param version The version of the entry the change is based on
+ * @param changes The fields to set, validated by parseEntryChanges
+ * @param cleared The optional fields to remove
+ * @return The entry before and after the update, error (mongo.ErrNoDocuments if the entry does not exist,
+ *	errVersionConflict if the entry has another version)
+ */
+func updateEntry(walletId primitive.ObjectID, entryId string, version int64, changes bson.M, cleared []string) (bson.M, bson.M, error) {
+	id, err := primitive.ObjectIDFromHex(entryId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return changeEntry(context.TODO(), walletId, id, version, changes, cleared)
+}
+
+// changeEntry updates an entry within the context, which may be a transaction. See updateEntry
+func changeEntry(ctx context.Context, walletId primitive.ObjectID, id primitive.ObjectID, version int64, changes bson.M, cleared []string) (bson.M, bson.M, error) {
+	update := bson.M{"$inc": bson.M{"version": 1}}
+	if len(changes) > 0 {
+		update["$set"] = changes
+	}
+	if len(cleared) > 0 {
+		unset := bson.M{}
+		for _, field := range cleared {
+			unset[field] = ""
+		}
+		update["$unset"] = unset
+	}
+
+	var before bson.M
+	err := getEntriesColl().FindOneAndUpdate(ctx, bson.M{
+		"_id":       id,
+		"wallet":    walletId,
+		"deletedAt": bson.M{"$exists": false},
+		"version":   version,
+	}, update).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil, versionMismatch(ctx, walletId, id)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	after := bson.M{}
+	for key, value := range before {
+		after[key] = value
+	}
+	for key, value := range changes {
+		after[key] = value
+	}
+	for _, field := range cleared {
+		delete(after, field)
+	}
+	after["version"] = version + 1
+	return before, after, nil
 }
 
 // MonthlyReport represents aggregated income/expense data for a single month
@@ -324,28 +622,23 @@ type MonthlyReport struct {
 	Expense float64 `bson:"expense" json:"expense"`
 }
 
-// getMonthlyReport aggregates entries by month for a given year
+// getMonthlyReport aggregates the entries matching the query by month for a given year in the timezone
 // Returns income (positive amounts) and expense (absolute value of negative amounts) per month
-func getMonthlyReport(year int) ([]MonthlyReport, error) {
+func getMonthlyReport(query map[string]interface{}, year int, location *time.Location) ([]MonthlyReport, error) {
 	// Define the date range for the year
-	startDate := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
-	endDate := time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC)
+	startDate := time.Date(year, 1, 1, 0, 0, 0, 0, location)
+	endDate := time.Date(year+1, 1, 1, 0, 0, 0, 0, location)
 
 	pipeline := []bson.M{
 		// Match entries within the year
 		{
-			"$match": bson.M{
-				"date": bson.M{
-					"$gte": startDate,
-					"$lt":  endDate,
-				},
-			},
+			"$match": matchDateRange(query, startDate, endDate),
 		},
 		// Group by month and calculate income/expense
 		{
 			"$group": bson.M{
 				"_id": bson.M{
-					"$month": "$date",
+					"$month": bson.M{"date": "$date", "timezone": location.String()},
 				},
 				"income": bson.M{
 					"$sum": bson.M{
@@ -384,7 +677,7 @@ func getMonthlyReport(year int) ([]MonthlyReport, error) {
 		},
 	}
 
-	cursor, err := getEntriesColl().Aggregate(context.TODO(), pipeline)
+	cursor, err := getEntriesColl().Aggregate(context.TODO(), pipeline, options.Aggregate().SetMaxTime(entryQueryTimeout))
 	if err != nil {
 		return nil, err
 	}
@@ -411,3 +704,11 @@ func getMonthlyReport(year int) ([]MonthlyReport, error) {
 
 	return fullReport, nil
 }
+
+// migrateEntryVersions gives entries created before versioning their first version
+func migrateEntryVersions() error {
+	_, err := getEntriesColl().UpdateMany(context.TODO(), bson.M{"version": bson.M{"$exists": false}}, bson.M{
+		"$set": bson.M{"version": 1},
+	})
+	return err
+}
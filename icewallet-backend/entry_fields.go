@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Limits of the optional entry fields
+const (
+	maxCategoryLength = 100
+	maxNotesLength    = 2000
+	maxTagLength      = 50
+	maxTags           = 20
+)
+
+// Entry fields that can be set through the API, mapped to whether they are optional.
+// Optional fields can be cleared by setting them to null
+var entryFields = map[string]bool{
+	"description": false,
+	"amount":      false,
+	"date":        false,
+	"category":    true,
+	"tags":        true,
+	"notes":       true,
+}
+
+// requiredEntryFields must be given when creating an entry
+var requiredEntryFields = []string{"description", "amount", "date"}
+
+// normalizeTags trims tags and removes empty and duplicate tags
+func normalizeTags(value interface{}) ([]string, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("tags must be an array of strings")
+	}
+
+	tags := make([]string, 0, len(items))
+	seen := make(map[string]bool)
+	for _, item := range items {
+		tag, ok := item.(string)
+		if !ok {
+			return nil, errors.New("tags must be an array of strings")
+		}
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, errors.New("tag is too long")
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, errors.New("too many tags")
+	}
+	return tags, nil
+}
+
+// parseEntryField validates the value of an entry field and converts it to its stored form
+func parseEntryField(field string, value interface{}) (interface{}, error) {
+	switch field {
+	case "description":
+		description, ok := value.(string)
+		if !ok {
+			return nil, errors.New("description must be a string")
+		}
+		return description, nil
+	case "amount":
+		amount, ok := value.(float64)
+		if !ok || math.IsNaN(amount) || math.IsInf(amount, 0) {
+			return nil, errors.New("amount must be a number")
+		}
+		return amount, nil
+	case "date":
+		dateStr, ok := value.(string)
+		if !ok {
+			return nil, errors.New("date must be a string")
+		}
+		date, err := time.Parse(time.RFC3339, dateStr)
+		if err != nil {
+			return nil, errors.New("date must be in RFC3339 format")
+		}
+		return date, nil
+	case "category":
+		category, ok := value.(string)
+		if !ok {
+			return nil, errors.New("category must be a string")
+		}
+		category = strings.TrimSpace(category)
+		if len(category) > maxCategoryLength {
+			return nil, errors.New("category is too long")
+		}
+		return category, nil
+	case "tags":
+		return normalizeTags(value)
+	case "notes":
+		notes, ok := value.(string)
+		if !ok {
+			return nil, errors.New("notes must be a string")
+		}
+		if len(notes) > maxNotesLength {
+			return nil, errors.New("notes are too long")
+		}
+		return notes, nil
+	default:
+		return nil, errors.New("unknown field: " + field)
+	}
+}
+
+/**
+ * Read the entry fields present in a request body. Fields that are absent are left unchanged,
+ * and optional fields set to null are cleared
+ * @param body The request body
+ * @param ignoredFields Fields of the body that are not entry fields, such as id and wallet
+ * @return The fields to set, the fields to clear, error if a field is unknown or invalid
+ */
+func parseEntryChanges(body map[string]interface{}, ignoredFields []string) (bson.M, []string, error) {
+	ignored := make(map[string]bool)
+	for _, field := range ignoredFields {
+		ignored[field] = true
+	}
+
+	changes := bson.M{}
+	cleared := []string{}
+	for field, value := range body {
+		if ignored[field] {
+			continue
+		}
+		optional, known := entryFields[field]
+		if !known {
+			return nil, nil, errors.New("unknown field: " + field)
+		}
+
+		if value == nil {
+			if !optional {
+				return nil, nil, errors.New(field + " cannot be cleared")
+			}
+			cleared = append(cleared, field)
+			continue
+		}
+		parsed, err := parseEntryField(field, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		changes[field] = parsed
+	}
+	return changes, cleared, nil
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"log"
+	"os"
+	"strconv"
+
 	"github.com/joho/godotenv"
 )
 
@@ -12,3 +16,19 @@ func loadEnvVars() error {
 
 	return nil
 }
+
+// getEnvInt reads an integer environment variable, falling back to the default value
+// if the variable is not set or is not a valid integer
+func getEnvInt(name string, defaultValue int) int {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		log.Printf("WARNING: %s is not a valid integer, using default value %d", name, defaultValue)
+		return defaultValue
+	}
+	return value
+}
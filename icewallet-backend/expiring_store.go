@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type expiringItem struct {
+	value   interface{}
+	expires time.Time
+}
+
+// expiringStore is an in-memory store for short-lived, single-use values
+// such as login nonces. Items are dropped once taken or once they expire.
+type expiringStore struct {
+	mutex sync.Mutex
+	ttl   time.Duration
+	items map[string]expiringItem
+}
+
+func newExpiringStore(ttl time.Duration) *expiringStore {
+	return &expiringStore{
+		ttl:   ttl,
+		items: make(map[string]expiringItem),
+	}
+}
+
+// put stores a value under the given key, replacing any previous value
+func (s *expiringStore) put(key string, value interface{}) time.Time {
+	return s.putUntil(key, value, time.Now().Add(s.ttl))
+}
+
+// putUntil stores a value under the given key until the given time, so that a value
+// that is taken and put back keeps its original expiry
+func (s *expiringStore) putUntil(key string, value interface{}, expires time.Time) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Drop expired items so the store does not grow unbounded
+	now := time.Now()
+	for k, item := range s.items {
+		if now.After(item.expires) {
+			delete(s.items, k)
+		}
+	}
+
+	s.items[key] = expiringItem{value: value, expires: expires}
+	return expires
+}
+
+// take removes the value stored under the given key and returns it.
+// The second return value is false if the key does not exist or has expired.
+func (s *expiringStore) take(key string) (interface{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, exists := s.items[key]
+	if !exists {
+		return nil, false
+	}
+	delete(s.items, key)
+
+	if time.Now().After(item.expires) {
+		return nil, false
+	}
+	return item.value, true
+}
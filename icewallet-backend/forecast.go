@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The minimum number of times an entry must appear to be considered recurring
+const minRecurringOccurrences = 3
+
+// The fraction of intervals and amounts that must match for an entry to be considered recurring,
+// so that one late payment or one unusual amount does not hide a pattern
+const recurringMatchRatio = 0.75
+
+// Amounts of a recurring entry may differ from their median by this fraction
+const recurringAmountTolerance = 0.25
+
+// recurrenceCadence is an interval at which entries can recur
+type recurrenceCadence struct {
+	Name string
+	// The average length of the interval in days
+	Days float64
+	// The number of days an interval may differ from the average
+	Tolerance float64
+	// Intervals of whole months are projected by calendar months, others by days
+	Months int
+}
+
+var recurrenceCadences = []recurrenceCadence{
+	{Name: "weekly", Days: 7, Tolerance: 1},
+	{Name: "biweekly", Days: 14, Tolerance: 2},
+	{Name: "monthly", Days: 30.44, Tolerance: 4, Months: 1},
+	{Name: "quarterly", Days: 91.31, Tolerance: 8, Months: 3},
+	{Name: "yearly", Days: 365.25, Tolerance: 10, Months: 12},
+}
+
+// recurringCandidate is a result of the $group stage finding entries that appear several times
+type recurringCandidate struct {
+	Key         string      `bson:"_id"`
+	Description string      `bson:"description"`
+	Dates       []time.Time `bson:"dates"`
+	Amounts     []float64   `bson:"amounts"`
+}
+
+// in returns the candidate with its dates in the location. Dates are decoded in UTC, while
+// months must be stepped and clamped on the calendar of the timezone days start in
+func (candidate recurringCandidate) in(location *time.Location) recurringCandidate {
+	dates := make([]time.Time, len(candidate.Dates))
+	for i, date := range candidate.Dates {
+		dates[i] = date.In(location)
+	}
+	candidate.Dates = dates
+	return candidate
+}
+
+// recurringItem is an entry detected to recur at a regular interval
+type recurringItem struct {
+	Description string    `json:"description"`
+	Amount      float64   `json:"amount"`
+	Cadence     string    `json:"cadence"`
+	Occurrences int       `json:"occurrences"`
+	LastDate    time.Time `json:"lastDate"`
+	NextDate    time.Time `json:"nextDate"`
+	cadence     recurrenceCadence
+}
+
+// forecastPoint is the projected balance at the end of a day
+type forecastPoint struct {
+	Date    time.Time `json:"date"`
+	Label   string    `json:"label"`
+	Balance float64   `json:"balance"`
+	// The net of the entries already dated on this day
+	Known float64 `json:"known"`
+	// The net of the recurring entries projected on this day
+	Projected float64 `json:"projected"`
+	// The descriptions of the recurring entries projected on this day
+	Items []string `json:"items"`
+}
+
+// cashFlowForecast is the result of getCashFlowForecast
+type cashFlowForecast struct {
+	Recurring      []recurringItem
+	Points         []forecastPoint
+	OpeningBalance float64
+}
+
+// recurrenceDate returns the date count intervals after start. Intervals of whole months keep the day
+// of the month of start, or end on the last day of shorter months, e.g. Jan 31, Feb 29, Mar 31
+func recurrenceDate(start time.Time, cadence recurrenceCadence, count int) time.Time {
+	if cadence.Months == 0 {
+		return start.AddDate(0, 0, int(cadence.Days)*count)
+	}
+	year, month, day := start.Date()
+	hour, min, sec := start.Clock()
+	firstOfMonth := time.Date(year, month+time.Month(cadence.Months*count), 1, hour, min, sec, start.Nanosecond(), start.Location())
+	if lastDay := firstOfMonth.AddDate(0, 1, -1).Day(); day > lastDay {
+		day = lastDay
+	}
+	return firstOfMonth.AddDate(0, 0, day-1)
+}
+
+// findRecurringCandidates finds the descriptions that appear at least minRecurringOccurrences times
+// among the entries matching the query in a date range, ignoring case
+func findRecurringCandidates(query map[string]interface{}, from time.Time, to time.Time) ([]recurringCandidate, error) {
+	pipeline := []bson.M{
+		{"$match": matchDateRange(query, from, to)},
+		{"$sort": bson.M{"date": 1}},
+		{
+			"$group": bson.M{
+				"_id":         bson.M{"$toLower": "$description"},
+				"description": bson.M{"$last": "$description"},
+				"dates":       bson.M{"$push": "$date"},
+				"amounts":     bson.M{"$push": "$amount"},
+				"count":       bson.M{"$sum": 1},
+			},
+		},
+		{"$match": bson.M{"count": bson.M{"$gte": minRecurringOccurrences}}},
+	}
+
+	cursor, err := getEntriesColl().Aggregate(context.TODO(), pipeline, options.Aggregate().SetMaxTime(entryQueryTimeout))
+	if err != nil {
+		return nil, err
+	}
+	var candidates []recurringCandidate
+	if err = cursor.All(context.Background(), &candidates); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+/**
+ * Check whether the entries of a description recur: most intervals between them must match a cadence,
+ * and most amounts must be close to their median
+ * @param candidate The dates, in chronological order, and amounts of the entries
+ * @return The recurring item, and whether the entries recur
+ */
+func detectRecurrence(candidate recurringCandidate) (recurringItem, bool) {
+	if len(candidate.Dates) < minRecurringOccurrences {
+		return recurringItem{}, false
+	}
+
+	intervals := make([]float64, 0, len(candidate.Dates)-1)
+	for i := 1; i < len(candidate.Dates); i++ {
+		intervals = append(intervals, candidate.Dates[i].Sub(candidate.Dates[i-1]).Hours()/24)
+	}
+	typicalInterval := median(append([]float64{}, intervals...))
+
+	var cadence *recurrenceCadence
+	for i := range recurrenceCadences {
+		if math.Abs(typicalInterval-recurrenceCadences[i].Days) <= recurrenceCadences[i].Tolerance {
+			cadence = &recurrenceCadences[i]
+			break
+		}
+	}
+	if cadence == nil {
+		return recurringItem{}, false
+	}
+	matching := 0
+	for _, interval := range intervals {
+		if math.Abs(interval-cadence.Days) <= cadence.Tolerance {
+			matching++
+		}
+	}
+	if float64(matching) < recurringMatchRatio*float64(len(intervals)) {
+		return recurringItem{}, false
+	}
+
+	amount := median(append([]float64{}, candidate.Amounts...))
+	if amount == 0 {
+		return recurringItem{}, false
+	}
+	matching = 0
+	for _, value := range candidate.Amounts {
+		if math.Abs(value-amount) <= recurringAmountTolerance*math.Abs(amount) {
+			matching++
+		}
+	}
+	if float64(matching) < recurringMatchRatio*float64(len(candidate.Amounts)) {
+		return recurringItem{}, false
+	}
+
+	lastDate := candidate.Dates[len(candidate.Dates)-1]
+	return recurringItem{
+		Description: candidate.Description,
+		Amount:      amount,
+		Cadence:     cadence.Name,
+		Occurrences: len(candidate.Dates),
+		LastDate:    lastDate,
+		NextDate:    recurrenceDate(lastDate, *cadence, 1),
+		cadence:     *cadence,
+	}, true
+}
+
+/**
+ * Project the balance of the entries matching the query for the next days, from the entries already dated
+ * in the future and from the entries detected to recur in the history. Recurring entries that have not
+ * appeared for more than one and a half intervals are considered stopped and are not projected
+ * @param query The query built by buildFilters
+ * @param days The number of days to project, starting today
+ * @param historyDays The number of past days to detect recurring entries in
+ * @param location The timezone days start in
+ * @return The forecast, error
+ */
+func getCashFlowForecast(query map[string]interface{}, days int, historyDays int, location *time.Location) (cashFlowForecast, error) {
+	now := time.Now().In(location)
+	today, _ := startOf(now, PeriodDay)
+	end := today.AddDate(0, 0, days)
+
+	// Entries dated in the future are part of the history, so that recurring entries
+	// already entered ahead of time are not projected twice
+	candidates, err := findRecurringCandidates(query, today.AddDate(0, 0, -historyDays), end)
+	if err != nil {
+		return cashFlowForecast{}, err
+	}
+	forecast := cashFlowForecast{Recurring: []recurringItem{}}
+	for _, candidate := range candidates {
+		item, recurs := detectRecurrence(candidate.in(location))
+		if !recurs {
+			continue
+		}
+		stoppedAfter := item.LastDate.Add(time.Duration(item.cadence.Days * 1.5 * float64(24*time.Hour)))
+		if stoppedAfter.Before(now) {
+			continue
+		}
+		forecast.Recurring = append(forecast.Recurring, item)
+	}
+	sort.Slice(forecast.Recurring, func(i, j int) bool {
+		return forecast.Recurring[i].NextDate.Before(forecast.Recurring[j].NextDate)
+	})
+
+	forecast.OpeningBalance, err = sumAmountsBefore(query, now)
+	if err != nil {
+		return cashFlowForecast{}, err
+	}
+	known, err := getPeriodReport(query, now, end, PeriodDay, location)
+	if err != nil {
+		return cashFlowForecast{}, err
+	}
+
+	forecast.Points = make([]forecastPoint, len(known))
+	dayIndexes := make(map[string]int)
+	for i, bucket := range known {
+		forecast.Points[i] = forecastPoint{Date: bucket.Start, Label: bucket.Label, Known: bucket.Net, Items: []string{}}
+		dayIndexes[bucket.Label] = i
+	}
+
+	// Project each recurring entry on the days it is due. Late entries are projected today
+	for _, item := range forecast.Recurring {
+		for count := 1; ; count++ {
+			date := recurrenceDate(item.LastDate, item.cadence, count)
+			if !date.Before(end) {
+				break
+			}
+			if date.Before(today) {
+				date = today
+			}
+			i, exists := dayIndexes[date.In(location).Format("2006-01-02")]
+			if !exists {
+				continue
+			}
+			forecast.Points[i].Projected += item.Amount
+			forecast.Points[i].Items = append(forecast.Points[i].Items, item.Description)
+		}
+	}
+
+	balance := forecast.OpeningBalance
+	for i := range forecast.Points {
+		balance += forecast.Points[i].Known + forecast.Points[i].Projected
+		forecast.Points[i].Balance = balance
+	}
+	return forecast, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// findCadence returns the cadence with the name
+func findCadence(t *testing.T, name string) recurrenceCadence {
+	for _, cadence := range recurrenceCadences {
+		if cadence.Name == name {
+			return cadence
+		}
+	}
+	t.Fatalf("unknown cadence %s", name)
+	return recurrenceCadence{}
+}
+
+func TestRecurrenceDate(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 9, 30, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name    string
+		start   time.Time
+		cadence string
+		count   int
+		want    time.Time
+	}{
+		{name: "weekly", start: date(2024, 5, 15), cadence: "weekly", count: 3, want: date(2024, 6, 5)},
+		{name: "biweekly", start: date(2024, 12, 20), cadence: "biweekly", count: 1, want: date(2025, 1, 3)},
+		{name: "monthly", start: date(2024, 1, 15), cadence: "monthly", count: 2, want: date(2024, 3, 15)},
+		{name: "monthly from the 31st", start: date(2024, 1, 31), cadence: "monthly", count: 1, want: date(2024, 2, 29)},
+		{name: "monthly from the 31st keeps the day", start: date(2024, 1, 31), cadence: "monthly", count: 2, want: date(2024, 3, 31)},
+		{name: "monthly into a 30 day month", start: date(2024, 3, 31), cadence: "monthly", count: 1, want: date(2024, 4, 30)},
+		{name: "monthly across years", start: date(2024, 11, 30), cadence: "monthly", count: 3, want: date(2025, 2, 28)},
+		{name: "quarterly", start: date(2024, 11, 30), cadence: "quarterly", count: 1, want: date(2025, 2, 28)},
+		{name: "yearly from a leap day", start: date(2024, 2, 29), cadence: "yearly", count: 1, want: date(2025, 2, 28)},
+		{name: "yearly back to a leap day", start: date(2024, 2, 29), cadence: "yearly", count: 4, want: date(2028, 2, 29)},
+		{name: "zero intervals", start: date(2024, 1, 31), cadence: "monthly", count: 0, want: date(2024, 1, 31)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := recurrenceDate(test.start, findCadence(t, test.cadence), test.count)
+			if !got.Equal(test.want) {
+				t.Errorf("recurrenceDate() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRecurrenceDateKeepsLocalTime(t *testing.T) {
+	// Monthly dates keep their time of day when crossing a daylight saving time change
+	toronto := mustLoadLocation(t, "America/Toronto")
+	start := time.Date(2024, 2, 29, 8, 0, 0, 0, toronto)
+	got := recurrenceDate(start, findCadence(t, "monthly"), 1)
+	if want := time.Date(2024, 3, 29, 8, 0, 0, 0, toronto); !got.Equal(want) {
+		t.Errorf("recurrenceDate() = %v, want %v", got, want)
+	}
+}
+
+// datesEvery returns start followed by one date after each interval, in days
+func datesEvery(start time.Time, days ...int) []time.Time {
+	dates := []time.Time{start}
+	for _, interval := range days {
+		dates = append(dates, dates[len(dates)-1].AddDate(0, 0, interval))
+	}
+	return dates
+}
+
+// monthlyDates returns count dates, the given number of months apart
+func monthlyDates(start time.Time, months int, count int) []time.Time {
+	var dates []time.Time
+	for i := 0; i < count; i++ {
+		dates = append(dates, start.AddDate(0, months*i, 0))
+	}
+	return dates
+}
+
+func TestDetectRecurrence(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		dates           []time.Time
+		amounts         []float64
+		wantRecurs      bool
+		wantCadence     string
+		wantAmount      float64
+		wantNextDate    time.Time
+		wantOccurrences int
+	}{
+		{name: "monthly rent", dates: monthlyDates(start, 1, 4), amounts: []float64{-1500, -1500, -1500, -1500},
+			wantRecurs: true, wantCadence: "monthly", wantAmount: -1500, wantNextDate: start.AddDate(0, 4, 0), wantOccurrences: 4},
+		{name: "biweekly pay with a raise", dates: datesEvery(start, 14, 14, 14, 14), amounts: []float64{2000, 2000, 2000, 2100, 2100},
+			wantRecurs: true, wantCadence: "biweekly", wantAmount: 2000, wantNextDate: start.AddDate(0, 0, 70), wantOccurrences: 5},
+		{name: "weekly with jitter", dates: datesEvery(start, 7, 8, 6, 7, 7), amounts: []float64{-20, -22, -19, -20, -21, -20},
+			wantRecurs: true, wantCadence: "weekly", wantAmount: -20, wantNextDate: start.AddDate(0, 0, 42), wantOccurrences: 6},
+		{name: "one late payment", dates: datesEvery(start, 7, 7, 7, 11, 3, 7, 7, 7), amounts: []float64{-10, -10, -10, -10, -10, -10, -10, -10, -10},
+			wantRecurs: true, wantCadence: "weekly", wantAmount: -10, wantNextDate: start.AddDate(0, 0, 63), wantOccurrences: 9},
+		{name: "one unusual amount", dates: monthlyDates(start, 1, 4), amounts: []float64{-50, -50, -120, -50},
+			wantRecurs: true, wantCadence: "monthly", wantAmount: -50, wantNextDate: start.AddDate(0, 4, 0), wantOccurrences: 4},
+		{name: "quarterly", dates: monthlyDates(start, 3, 3), amounts: []float64{-300, -300, -300},
+			wantRecurs: true, wantCadence: "quarterly", wantAmount: -300, wantNextDate: start.AddDate(0, 9, 0), wantOccurrences: 3},
+		{name: "yearly", dates: monthlyDates(start, 12, 3), amounts: []float64{-99, -99, -109},
+			wantRecurs: true, wantCadence: "yearly", wantAmount: -99, wantNextDate: start.AddDate(3, 0, 0), wantOccurrences: 3},
+		{name: "too few occurrences", dates: monthlyDates(start, 1, 2), amounts: []float64{-1500, -1500}},
+		{name: "irregular intervals", dates: datesEvery(start, 3, 20, 9, 45), amounts: []float64{-30, -30, -30, -30, -30}},
+		{name: "no matching cadence", dates: datesEvery(start, 45, 45, 45), amounts: []float64{-30, -30, -30, -30}},
+		{name: "too many late intervals", dates: datesEvery(start, 7, 7, 10, 4, 7), amounts: []float64{-10, -10, -10, -10, -10, -10}},
+		{name: "varying amounts", dates: datesEvery(start, 7, 7, 7), amounts: []float64{-3.5, -12, -4, -25}},
+		{name: "zero amounts", dates: datesEvery(start, 7, 7, 7), amounts: []float64{0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item, recurs := detectRecurrence(recurringCandidate{Key: "key", Description: "Item", Dates: test.dates, Amounts: test.amounts})
+			if recurs != test.wantRecurs {
+				t.Fatalf("detectRecurrence() recurs = %v, want %v (%+v)", recurs, test.wantRecurs, item)
+			}
+			if !recurs {
+				return
+			}
+			if item.Cadence != test.wantCadence || item.Amount != test.wantAmount || item.Occurrences != test.wantOccurrences {
+				t.Errorf("detectRecurrence() = %s %v x%d, want %s %v x%d",
+					item.Cadence, item.Amount, item.Occurrences, test.wantCadence, test.wantAmount, test.wantOccurrences)
+			}
+			if !item.LastDate.Equal(test.dates[len(test.dates)-1]) || !item.NextDate.Equal(test.wantNextDate) {
+				t.Errorf("detectRecurrence() last %v next %v, want next %v", item.LastDate, item.NextDate, test.wantNextDate)
+			}
+			if item.Description != "Item" || item.cadence.Name != item.Cadence {
+				t.Errorf("detectRecurrence() = %+v", item)
+			}
+		})
+	}
+}
+
+func TestDetectRecurrenceInLocation(t *testing.T) {
+	// Entries on the 30th at 21:00 in Toronto are stored on the 31st in UTC, so the next
+	// date is only on the 30th when months are stepped on the local calendar
+	toronto := mustLoadLocation(t, "America/Toronto")
+	candidate := recurringCandidate{Key: "key", Description: "Item", Amounts: []float64{-80, -80, -80}}
+	for _, month := range []time.Month{1, 2, 3} {
+		candidate.Dates = append(candidate.Dates, time.Date(2024, month, 30, 21, 0, 0, 0, toronto).UTC())
+	}
+	candidate.Dates[1] = time.Date(2024, 2, 29, 21, 0, 0, 0, toronto).UTC()
+
+	item, recurs := detectRecurrence(candidate.in(toronto))
+	if !recurs {
+		t.Fatal("detectRecurrence() recurs = false, want true")
+	}
+	if want := time.Date(2024, 4, 30, 21, 0, 0, 0, toronto); !item.NextDate.Equal(want) {
+		t.Errorf("detectRecurrence() next %v, want %v", item.NextDate.In(toronto), want)
+	}
+	if want := time.Date(2024, 5, 30, 21, 0, 0, 0, toronto); !recurrenceDate(item.LastDate, item.cadence, 2).Equal(want) {
+		t.Errorf("recurrenceDate() = %v, want %v", recurrenceDate(item.LastDate, item.cadence, 2).In(toronto), want)
+	}
+	if candidate.Dates[0].Location() != time.UTC {
+		t.Error("in() changed the dates of the candidate")
+	}
+}
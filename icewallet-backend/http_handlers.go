@@ -1,13 +1,22 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"net/http"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func checkBodyFields(json map[string]interface{}, fields []string, typeNames []string) bool {
@@ -19,23 +28,276 @@ func checkBodyFields(json map[string]interface{}, fields []string, typeNames []s
 	return true
 }
 
+// authorizeScope checks that the session grants the scope, and responds with 403 Forbidden if not
+func authorizeScope(w http.ResponseWriter, session authSession, scope string) bool {
+	if !session.hasScope(scope) {
+		http.Error(w, "Insufficient scope", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireSessionToken responds with 403 Forbidden if the request was authenticated with an API key.
+// Used by account management routes, which API keys cannot access
+func requireSessionToken(w http.ResponseWriter, session authSession) bool {
+	if session.isApiKey() {
+		http.Error(w, "API keys cannot access this route", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+/**
+ * Read the entry version a change is based on, from the If-Match header or the "version" field of the body.
+ * Writes 428 Precondition Required if neither is given
+ * @return The version, and whether the request may proceed
+ */
+func parseEntryVersion(w http.ResponseWriter, r *http.Request, body map[string]interface{}) (int64, bool) {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), "\""), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+			return 0, false
+		}
+		return version, true
+	}
+	if version, ok := body["version"].(float64); ok {
+		return int64(version), true
+	}
+	http.Error(w, "Entry version is required", http.StatusPreconditionRequired)
+	return 0, false
+}
+
+// writeVersionConflict responds with 409 Conflict and the current content of the entry
+func writeVersionConflict(w http.ResponseWriter, walletId primitive.ObjectID, entryId string) {
+	current, err := findEntry(walletId, entryId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", "\""+strconv.FormatInt(entryVersion(current), 10)+"\"")
+	w.WriteHeader(http.StatusConflict)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   errVersionConflict.Error(),
+		"current": current,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// writeTooManyRequests responds with 429 Too Many Requests and a Retry-After header in seconds
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+/**
+ * Find the wallet named by the "wallet" field of the request body, and check the user's role in it.
+ * Writes an error response if the wallet is invalid or the user lacks permission
+ * @return The wallet id, and whether the request may proceed
+ */
+func authorizeWalletRequest(w http.ResponseWriter, session authSession, body map[string]interface{}, requiredRole string) (primitive.ObjectID, bool) {
+	walletIdStr, _ := body["wallet"].(string)
+	walletId, err := authorizeWallet(session.userId, walletIdStr, requiredRole)
+	if err == errWalletForbidden {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return primitive.NilObjectID, false
+	} else if err != nil {
+		http.Error(w, "Invalid wallet", http.StatusBadRequest)
+		return primitive.NilObjectID, false
+	}
+	return walletId, true
+}
+
+// resolveTimezone finds the timezone of the request, see findUserLocation, and stores it in the "timezone"
+// field of the body so that relative dates in filters use it. Writes an error response if the timezone is invalid
+func resolveTimezone(w http.ResponseWriter, session authSession, body map[string]interface{}) (*time.Location, bool) {
+	location, err := findUserLocation(session.userId, body["timezone"])
+	if err != nil && body["timezone"] != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	body["timezone"] = location.String()
+	return location, true
+}
+
+// resolveSavedFilter applies the saved filter referenced by the "savedFilter" field of the body, see applySavedFilter.
+// Writes an error response if the saved filter cannot be used
+func resolveSavedFilter(w http.ResponseWriter, session authSession, body map[string]interface{}) bool {
+	err := applySavedFilter(session.userId, body)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Saved filter not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+/**
+ * Read the filter, savedFilter and timezone fields of a report request.
+ * Writes an error response if any field is invalid
+ * @return The filters, the timezone of the report, and whether the request may proceed
+ */
+func parseReportFilters(w http.ResponseWriter, session authSession, body map[string]interface{}) ([]entryFilter, *time.Location, bool) {
+	if !resolveSavedFilter(w, session, body) {
+		return nil, nil, false
+	}
+	location, ok := resolveTimezone(w, session, body)
+	if !ok {
+		return nil, nil, false
+	}
+
+	var filters []entryFilter
+	if body["filter"] != nil {
+		if !checkBodyFields(body, []string{"filter"}, []string{"[]interface {}"}) {
+			http.Error(w, "Invalid filter", http.StatusBadRequest)
+			return nil, nil, false
+		}
+		var err error
+		filters, err = parseFiltersFromHttpBody(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, nil, false
+		}
+	}
+	return filters, location, true
+}
+
+/**
+ * Read the entries a report covers from the filter, savedFilter, search, timezone and wallet fields of the body,
+ * and check that the user can view the wallet. Writes an error response if any field is invalid
+ * @return The query built by buildFilters, the timezone of the report, and whether the request may proceed
+ */
+func parseReportQuery(w http.ResponseWriter, session authSession, body map[string]interface{}) (map[string]interface{}, *time.Location, bool) {
+	filters, location, ok := parseReportFilters(w, session, body)
+	if !ok {
+		return nil, nil, false
+	}
+
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, body, RoleViewer)
+	if !ok {
+		return nil, nil, false
+	}
+	query, ok := buildSearchQuery(w, walletId, filters, body)
+	if !ok {
+		return nil, nil, false
+	}
+	return query, location, true
+}
+
+/**
+ * Build the query of the entries of a wallet matching the filters and the "search" field of the body,
+ * which a saved filter may have set. Writes an error response if the search is invalid
+ * @return The query, and whether the request may proceed
+ */
+func buildSearchQuery(w http.ResponseWriter, walletId primitive.ObjectID, filters []entryFilter, body map[string]interface{}) (map[string]interface{}, bool) {
+	search, isString := body["search"].(string)
+	if body["search"] != nil && !isString {
+		http.Error(w, "Invalid search", http.StatusBadRequest)
+		return nil, false
+	}
+	query, err := buildFilters(walletId, filters)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if _, err = addSearchToQuery(query, search); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return query, true
+}
+
+/**
+ * Read the date range of a report, either from the "range" field holding a relative period such as
+ * "last-quarter", or from the "from" and "to" fields holding RFC3339 or relative dates.
+ * A relative period given as "to" ends the range at the end of the period
+ * Writes 400 Bad Request if the range is invalid
+ * @return The start and the excluded end of the range, and whether the request may proceed
+ */
+func parseReportRange(w http.ResponseWriter, body map[string]interface{}, location *time.Location) (time.Time, time.Time, bool) {
+	now := time.Now().In(location)
+	var from, to time.Time
+	if rangeStr, isString := body["range"].(string); isString {
+		period, err := parseRelativeDate(rangeStr, now)
+		if err != nil || !period.isPeriod() {
+			http.Error(w, "Invalid range", http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		from, to = period.Start, period.End
+	} else {
+		if !checkBodyFields(body, []string{"from", "to"}, []string{"string", "string"}) {
+			http.Error(w, "Missing range", http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		fromRange, err := parseDateValue(body["from"].(string), now)
+		if err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		toRange, err := parseDateValue(body["to"].(string), now)
+		if err != nil {
+			http.Error(w, "Invalid to date", http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		from, to = fromRange.Start, toRange.Start
+		if toRange.isPeriod() {
+			to = toRange.End
+		}
+	}
+
+	if !from.Before(to) {
+		http.Error(w, "The range must end after it starts", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// writeReportError responds to a failed report with 400 Bad Request if the request asked too much, or 500 otherwise
+func writeReportError(w http.ResponseWriter, err error) {
+	if isQueryTimeout(err) {
+		http.Error(w, "Filter took too long, try a simpler regular expression", http.StatusBadRequest)
+	} else if err == errTooManyBuckets {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
 /*
 POST /createEntry
 Create a new entry
-Header: Authorization: <token>
-Body fields: desc, amount, date
-	desc: the description of the entry
+Header: Authorization: <token or API key>
+Body fields: description, amount, date, category, tags, notes, wallet
+	description: the description of the entry
 	amount: the amount of the entry
 	date: the date of the entry
+	category (optional): the category of the entry, up to 100 characters
+	tags (optional): an array of tags, up to 20 tags of up to 50 characters each
+	notes (optional): free text notes, up to 2000 characters
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
 Response: 201 Created if successful, no body
+	400 Bad Request if a field is invalid
+	403 Forbidden if the user is not an editor or owner of the wallet
 */
 func createEntryHandler(w http.ResponseWriter, r *http.Request) {
 	// Verify token
-	token := r.Header.Get("Authorization")
-	if !verifyToken(token) {
+	session, ok := authenticateRequest(r)
+	if !ok {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
+	if !authorizeScope(w, session, ScopeWriteEntries) {
+		return
+	}
 
 	// Parse body
 	var entry map[string]interface{}
@@ -44,17 +306,31 @@ func createEntryHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
-	if !checkBodyFields(entry, []string{"description", "amount", "date"}, []string{"string", "float64", "string"}) {
+	if !checkBodyFields(entry, requiredEntryFields, []string{"string", "float64", "string"}) {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
+	// Read-only fields are ignored, so that a fetched entry can be sent back as a new one
+	fields, _, err := parseEntryChanges(entry, []string{"wallet", "_id", "owner", "createTime", "version", "deletedAt", relevanceField})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, entry, RoleEditor)
+	if !ok {
+		return
+	}
 
 	// Create entry
-	err = insertEntry(entry["description"].(string), entry["amount"].(float64), entry["date"].(string))
+	newEntry, err := insertEntry(walletId, session.userId, fields)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	recordRevision(walletId, newEntry.Id, session.userId, RevisionCreate, nil, newEntry)
+	recordAuditEvent(r, session, AuditCreateEntry, &walletId, &newEntry.Id, nil, newEntry)
 
 	w.WriteHeader(http.StatusCreated)
 }
@@ -62,22 +338,47 @@ func createEntryHandler(w http.ResponseWriter, r *http.Request) {
 /*
 POST /getEntries
 Get entries according to the provided filter and limit. Also return the number and sum of all entries that match the filter.
-Header: Authorization: <token>
-Body fields: filter, start, limit, sort
-	filter: an array of entryFilter objects
-	start: the index of the first entry to return
+Header: Authorization: <token or API key>
+Body fields: filter, savedFilter, timezone, search, start, limit, sort, cursor, wallet
+	filter: an array of entryFilter objects { type, operator, value }. Date values are RFC3339 or relative to now:
+		points in time such as "now-30d" or "start-of-quarter", or periods such as "today", "this-week",
+		"last-month" or "ytd". A period compares as a whole, so Eq matches dates within it and Gt dates after it.
+		String ops apply to descriptions only:
+		6 Contains, 7 NotContains (entries whose description does not contain the value), 8 StartsWith,
+		9 EndsWith, 10 EqualsIgnoreCase, 12 Regex. Op 11 In takes a list of up to 100 descriptions or amounts.
+		Regular expressions are limited to 100 characters, nested repetitions such as (a+)+ are rejected,
+		and filters that take longer than 5 seconds fail with 400 Bad Request
+	savedFilter (optional): the id of a saved filter, see /createSavedFilter. Its filters are added to filter,
+		and its sort and search are used unless given. filter may be omitted with a saved filter
+	timezone (optional): the IANA timezone relative dates are resolved in, such as "America/Toronto".
+		Defaults to the user's timezone, see /updateSettings
+	search (optional): words to search for in descriptions and notes. Words ending with * match as prefixes,
+		and phrases in double quotes must appear as is
+	start: the index of the first entry to return, ignored when a cursor is given
 	limit: the maximum number of entries to return. Cannot be greater than 100
-	sort: the field to sort by. Must be one of desc, amount, date, dateOfEntry
+	sort: the fields to sort by, either as a string such as "date:desc,amount:asc" or as an array such as
+		[{ field: "date", order: "desc" }, { field: "amount", order: "asc" }]. Fields are date, amount,
+		description (or desc) and createTime (or entryDate), and are descending if no order is given.
+		Up to 3 fields, unknown fields are rejected with 400 Bad Request. With a search, the sort defaults to
+		relevance, which cannot be paged with cursors
+	cursor (optional): nextCursor or prevCursor of a previous response, to get the page after or before it.
+		Unlike start, cursors keep pages stable when entries are added or removed while paging
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
 Response:
-	{ entries: [entry], total: <amount of entries>, count: <number of entries> }
+	{ entries: [entry], nextCursor: <cursor>, prevCursor: <cursor>, total: <amount of entries>, count: <number of entries> }
+	Each entry has a version, which /updateEntry and /deleteEntry require.
+	nextCursor and prevCursor are empty if there is no page after or before
 */
 func getEntriesHandler(w http.ResponseWriter, r *http.Request) {
 	// Verify token
-	token := r.Header.Get("Authorization")
-	if !verifyToken(token) {
+	session, ok := authenticateRequest(r)
+	if !ok {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
+	if !authorizeScope(w, session, ScopeReadEntries) {
+		return
+	}
 
 	// Parse body
 	var searchInfo map[string]interface{}
@@ -86,7 +387,13 @@ func getEntriesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
-	if !checkBodyFields(searchInfo, []string{"filter", "start", "limit", "sort"}, []string{"[]interface {}", "float64", "float64", "string"}) {
+	if !resolveSavedFilter(w, session, searchInfo) {
+		return
+	}
+	if _, ok = resolveTimezone(w, session, searchInfo); !ok {
+		return
+	}
+	if !checkBodyFields(searchInfo, []string{"filter", "start", "limit"}, []string{"[]interface {}", "float64", "float64"}) {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
@@ -95,7 +402,7 @@ func getEntriesHandler(w http.ResponseWriter, r *http.Request) {
 	var filters []entryFilter
 	filters, err = parseFiltersFromHttpBody(searchInfo)
 	if err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -107,17 +414,51 @@ func getEntriesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check if sort is valid. Searches are sorted by relevance by default
+	search, _ := searchInfo["search"].(string)
+	sortValue := searchInfo["sort"]
+	if sortValue == nil && strings.TrimSpace(search) != "" {
+		sortValue = "relevance"
+	}
+	sort, err := parseEntrySort(sortValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, searchInfo, RoleViewer)
+	if !ok {
+		return
+	}
+
 	// Search entries
 	var query map[string]interface{}
-	query, err = buildFilters(filters)
+	query, err = buildFilters(walletId, filters)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	usesText, err := addSearchToQuery(query, search)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sort.byRelevance() && !usesText {
+		// Prefix-only searches have no relevance
+		sort, _ = parseEntrySort(nil)
+	}
+	cursorStr, _ := searchInfo["cursor"].(string)
+	if cursorStr != "" {
+		if _, err = decodeCursor(sort, cursorStr); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
 
-	var entriesResult []bson.M
+	var page entryPage
 	var aggregationResult bson.M
-	hasError := false
+	var findErr, sumErr error
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
@@ -125,33 +466,29 @@ func getEntriesHandler(w http.ResponseWriter, r *http.Request) {
 	// Get entries content
 	go func() {
 		defer wg.Done()
-
-		entriesResult, err = findEntries(query, start, limit, searchInfo["sort"].(string))
-		if err != nil {
-			hasError = true
-			return
-		}
+		page, findErr = findEntries(query, start, limit, sort, cursorStr)
 	}()
 
 	// Get entries count and sum
 	go func() {
 		defer wg.Done()
-
-		aggregationResult, err = sumAndCountEntries(query)
-		if err != nil {
-			hasError = true
-			return
-		}
+		aggregationResult, sumErr = sumAndCountEntries(query)
 	}()
 
 	wg.Wait()
-	if hasError {
+	if isQueryTimeout(findErr) || isQueryTimeout(sumErr) {
+		http.Error(w, "Filter took too long, try a simpler regular expression", http.StatusBadRequest)
+		return
+	}
+	if findErr != nil || sumErr != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	err = json.NewEncoder(w).Encode(map[string]interface{}{
-		"entries":        entriesResult,
+		"entries":        page.Entries,
+		"nextCursor":     page.NextCursor,
+		"prevCursor":     page.PrevCursor,
 		"positiveAmount": aggregationResult["positiveTotal"],
 		"negativeAmount": aggregationResult["negativeTotal"],
 		"count":          aggregationResult["count"],
@@ -164,19 +501,28 @@ func getEntriesHandler(w http.ResponseWriter, r *http.Request) {
 
 /*
 POST /deleteEntry
-Delete specified entry
-Header: Authorization: <token>
-Body fields: id
+Move specified entry to the trash. Trashed entries can be restored with /restoreEntry until they are purged
+Header: Authorization: <token or API key>, If-Match: <version> (or the version body field)
+Body fields: id, version, wallet
 	id: the id of the entry to delete
+	version: the version of the entry as returned by /getEntries, required unless If-Match is set
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
 Response: 200 OK if successful, no body
+	403 Forbidden if the user is not an editor or owner of the wallet
+	404 Not Found if the entry does not exist or is already in the trash
+	409 Conflict if the entry was changed since that version, with body { error, current: <entry> }
+	428 Precondition Required if no version is given
 */
 func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
 	// Verify token
-	token := r.Header.Get("Authorization")
-	if !verifyToken(token) {
+	session, ok := authenticateRequest(r)
+	if !ok {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
+	if !authorizeScope(w, session, ScopeWriteEntries) {
+		return
+	}
 
 	// Parse body
 	var deleteInfo map[string]interface{}
@@ -190,34 +536,66 @@ func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, deleteInfo, RoleEditor)
+	if !ok {
+		return
+	}
+	version, ok := parseEntryVersion(w, r, deleteInfo)
+	if !ok {
+		return
+	}
+
 	// Delete entries
-	err = deleteEntries(deleteInfo["id"].(string))
-	if err != nil {
+	before, after, err := deleteEntries(walletId, deleteInfo["id"].(string), version)
+	if err == errVersionConflict {
+		writeVersionConflict(w, walletId, deleteInfo["id"].(string))
+		return
+	} else if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if before == nil {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	entryId := before["_id"].(primitive.ObjectID)
+	recordRevision(walletId, entryId, session.userId, RevisionDelete, before, after)
+	recordAuditEvent(r, session, AuditDeleteEntry, &walletId, &entryId, before, after)
 
 	w.WriteHeader(http.StatusOK)
 }
 
 /*
 POST /updateEntry
-Update an entry, provided the id and the new content
-Header: Authorization: <token>
-Body fields: id, description, amount, date
+Update some fields of an entry. Only the fields present in the body are changed, and optional fields
+set to null are cleared
+Header: Authorization: <token or API key>, If-Match: <version> (or the version body field)
+Body fields: id, version, description, amount, date, category, tags, notes, wallet
 	id: the id of the entry to update
-	description: the new description
-	amount: the new amount
-	date: the new date
+	version: the version of the entry as returned by /getEntries, required unless If-Match is set
+	description (optional): the new description
+	amount (optional): the new amount
+	date (optional): the new date
+	category, tags, notes (optional): the new optional fields, see /createEntry, or null to clear them
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
 Response: 200 OK if successful, no body
+	400 Bad Request if a field is unknown or invalid, or no field is given
+	403 Forbidden if the user is not an editor or owner of the wallet
+	404 Not Found if the entry does not exist
+	409 Conflict if the entry was changed since that version, with body { error, current: <entry> }
+	428 Precondition Required if no version is given
 */
 func updateEntryHandler(w http.ResponseWriter, r *http.Request) {
 	// Verify token
-	token := r.Header.Get("Authorization")
-	if !verifyToken(token) {
+	session, ok := authenticateRequest(r)
+	if !ok {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
+	if !authorizeScope(w, session, ScopeWriteEntries) {
+		return
+	}
 
 	// Parse body
 	var updateInfo map[string]interface{}
@@ -226,17 +604,45 @@ func updateEntryHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
-	if !checkBodyFields(updateInfo, []string{"id", "description", "amount", "date"}, []string{"string", "string", "float64", "string"}) {
+	if !checkBodyFields(updateInfo, []string{"id"}, []string{"string"}) {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
+	changes, cleared, err := parseEntryChanges(updateInfo, []string{"id", "version", "wallet"})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(changes) == 0 && len(cleared) == 0 {
+		http.Error(w, "No fields to update", http.StatusBadRequest)
+		return
+	}
+
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, updateInfo, RoleEditor)
+	if !ok {
+		return
+	}
+	version, ok := parseEntryVersion(w, r, updateInfo)
+	if !ok {
+		return
+	}
 
 	// Update entry
-	err = updateEntry(updateInfo["id"].(string), updateInfo["description"].(string), updateInfo["amount"].(float64), updateInfo["date"].(string))
-	if err != nil {
+	before, after, err := updateEntry(walletId, updateInfo["id"].(string), version, changes, cleared)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	} else if err == errVersionConflict {
+		writeVersionConflict(w, walletId, updateInfo["id"].(string))
+		return
+	} else if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	entryId := before["_id"].(primitive.ObjectID)
+	recordRevision(walletId, entryId, session.userId, RevisionUpdate, before, after)
+	recordAuditEvent(r, session, AuditUpdateEntry, &walletId, &entryId, before, after)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -245,18 +651,22 @@ func updateEntryHandler(w http.ResponseWriter, r *http.Request) {
 POST /changePassword
 Change the login password
 Header: Authorization: <token>
-Body fields: oldPassword, newPassword
-	oldPassword: the user's current password, encrypted with the server's public key
-	newPassword: the user's new password, encrypted with the server's public key
+Body fields: oldPassword, newPassword, scheme
+	oldPassword: the user's current password, sealed with the server's public key
+	newPassword: the user's new password, sealed with the server's public key
+	scheme: the password transport scheme, see /login. Both passwords must carry the same nonce
 Response: 200 OK if successful, no body
 */
 func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
 	// Verify token
-	token := r.Header.Get("Authorization")
-	if !verifyToken(token) {
+	session, ok := authenticateRequest(r)
+	if !ok {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
+	if !requireSessionToken(w, session) {
+		return
+	}
 
 	// Parse body
 	var changeInfo map[string]interface{}
@@ -270,45 +680,86 @@ func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Decrypt the old password
-	oldPassword, err := decryptPassword(changeInfo["oldPassword"].(string))
+	// Decrypt the passwords
+	passwords, err := unsealPasswords(changeInfo, []string{"oldPassword", "newPassword"})
 	if err != nil {
-		http.Error(w, "Invalid old password", http.StatusBadRequest)
+		http.Error(w, "Invalid password encryption", http.StatusBadRequest)
+		return
+	}
+	oldPassword, newPassword := passwords[0], passwords[1]
+	user, err := findUserById(session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	if !verifyPassword(oldPassword) {
+	if _, ok := verifyPassword(user.Username, oldPassword); !ok {
 		http.Error(w, "Invalid old password", http.StatusBadRequest)
 		return
 	}
 
-	// Decrypt the new password
-	var newPassword string
-	newPassword, err = decryptPassword(changeInfo["newPassword"].(string))
+	// Update the password
+	err = changePassword(session.userId, newPassword)
 	if err != nil {
-		http.Error(w, "Invalid new password", http.StatusBadRequest)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	recordAuditEvent(r, session, AuditChangePassword, nil, nil, nil, nil)
 
-	// Update the password
-	err = changePassword(newPassword)
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+GET /getLoginNonce
+Obtain a single-use nonce to be sealed together with the password on login or password change.
+The nonce expires after 2 minutes
+Header: none
+Body fields: none
+Response:
+	{ nonce: <nonce>, expires: <expiry time> }
+*/
+func getLoginNonceHandler(w http.ResponseWriter, r *http.Request) {
+	nonce, expires, err := generateLoginNonce()
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"nonce":   nonce,
+		"expires": expires,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 }
 
 /*
 POST /login
 Login to the server and get a token
 Header: none
-Body fields: password
-	password: the user's password, encrypted with the server's public key
+Body fields: username, password, scheme
+	username: the username, case insensitive
+	password: the user's password, sealed with the server's public key
+	scheme: the password transport scheme. Either
+		"rsa-oaep-sha256": password is the base64 RSA-OAEP (SHA-256) encryption of
+			{ "password": <password>, "nonce": <nonce from /getLoginNonce> }
+		"rsa-pkcs1v15" (default if omitted): password is the base64 RSA-PKCS1v15 encryption of
+			the plain password. Only accepted if LEGACY_PASSWORD_TRANSPORT is true
 Response:
 	{ token: <token> }
+	{ twoFactorRequired: true, ticket: <ticket> } if two-factor authentication is enabled.
+		The ticket must then be sent to /loginTwoFactor with the TOTP code
+	429 Too Many Requests with a Retry-After header if the client is rate limited or locked out
 */
 func loginHandler(w http.ResponseWriter, r *http.Request) {
+	// Check rate limits and lockout
+	clientIp := getClientIp(r)
+	if ok, retryAfter := checkLoginAllowed(clientIp); !ok {
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
 	// Parse body
 	var password map[string]interface{}
 	err := json.NewDecoder(r.Body).Decode(&password)
@@ -316,28 +767,56 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
-	if !checkBodyFields(password, []string{"password"}, []string{"string"}) {
+	if !checkBodyFields(password, []string{"username", "password"}, []string{"string", "string"}) {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
 
 	// Decrypt the password
-	var decryptedPassword string
-	decryptedPassword, err = decryptPassword(password["password"].(string))
+	passwords, err := unsealPasswords(password, []string{"password"})
 	if err != nil {
-		http.Error(w, "Invalid password", http.StatusBadRequest)
+		http.Error(w, "Invalid password encryption", http.StatusBadRequest)
 		return
 	}
 
 	// Verify password
-	if !verifyPassword(decryptedPassword) {
-		http.Error(w, "Invalid password", http.StatusBadRequest)
+	user, ok := verifyPassword(password["username"].(string), passwords[0])
+	if !ok {
+		err = recordLoginFailure(ipSubject(clientIp))
+		if err != nil {
+			log.Println("Failed to record login failure:", err)
+		}
+		http.Error(w, "Invalid username or password", http.StatusBadRequest)
+		return
+	}
+
+	// Ask for the second factor if enabled. Failures are only cleared once it is verified
+	if isTotpEnabled(user.Id) {
+		var ticket string
+		ticket, err = createTwoFactorTicket(user.Id)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(map[string]interface{}{
+			"twoFactorRequired": true,
+			"ticket":            ticket,
+		})
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 		return
 	}
+	err = clearLoginFailures(ipSubject(clientIp))
+	if err != nil {
+		log.Println("Failed to clear login failures:", err)
+	}
 
 	// Create token
 	var token string
-	token, err = generateToken()
+	token, err = generateToken(user.Id)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -355,44 +834,87 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 /*
-POST /logout
-Delete the token from the server
-Header: Authorization: <token>
-Body fields: none
-Response: 200 OK if successful, no body
+POST /loginTwoFactor
+Finish a login that requires two-factor authentication and get a token
+Header: none
+Body fields: ticket, code
+	ticket: the ticket returned by /login
+	code: the current TOTP code, or one of the recovery codes
+Response:
+	{ token: <token> }
+	A ticket becomes invalid 5 minutes after /login or after 3 wrong codes
+	429 Too Many Requests with a Retry-After header if the client or the user is rate limited or locked out
 */
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Verify token
-	token := r.Header.Get("Authorization")
-	if !verifyToken(token) {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	// Check rate limits and lockout
+	clientIp := getClientIp(r)
+	if ok, retryAfter := checkLoginAllowed(clientIp); !ok {
+		writeTooManyRequests(w, retryAfter)
 		return
 	}
 
-	// Delete token
-	err := deleteToken(token)
+	// Parse body
+	var loginInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&loginInfo)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(loginInfo, []string{"ticket", "code"}, []string{"string", "string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-}
+	// Check the ticket
+	ticketId := loginInfo["ticket"].(string)
+	value, ok := pendingTwoFactorLogins.take(ticketId)
+	if !ok {
+		http.Error(w, "Invalid ticket", http.StatusBadRequest)
+		return
+	}
+	ticket := value.(twoFactorTicket)
 
-/*
-POST /getPublicKey
-Obtain the server's public key
-Header: none
-Body fields: none
-Response:
-	{ publicKey: <public key> }
-*/
-func getPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
-	// Send public key
-	var publicKeyJson map[string]string
-	publicKeyJson = make(map[string]string)
-	publicKeyJson["key"] = publicKeyStr
-	err := json.NewEncoder(w).Encode(publicKeyJson)
+	// Wrong codes are also counted per user, so that they add up across IPs and tickets
+	if ok, retryAfter := checkLoginLockout(userSubject(ticket.userId)); !ok {
+		pendingTwoFactorLogins.putUntil(ticketId, ticket, ticket.expires)
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
+	// Verify the code
+	if !verifySecondFactor(ticket.userId, loginInfo["code"].(string)) {
+		for _, subject := range []loginSubject{ipSubject(clientIp), userSubject(ticket.userId)} {
+			err = recordLoginFailure(subject)
+			if err != nil {
+				log.Println("Failed to record login failure:", err)
+			}
+		}
+		// The ticket keeps its expiry, and is dropped after too many wrong codes
+		ticket.attempts++
+		if ticket.attempts < maxTwoFactorAttempts {
+			pendingTwoFactorLogins.putUntil(ticketId, ticket, ticket.expires)
+		}
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	for _, subject := range []loginSubject{ipSubject(clientIp), userSubject(ticket.userId)} {
+		err = clearLoginFailures(subject)
+		if err != nil {
+			log.Println("Failed to clear login failures:", err)
+		}
+	}
+
+	// Create token
+	var token string
+	token, err = generateToken(ticket.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]string{
+		"token": token,
+	})
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -400,94 +922,2325 @@ func getPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 /*
-POST /clearTokens
-Delete all tokens from the server
+POST /enableTwoFactor
+Start enrolling TOTP two-factor authentication. Two-factor authentication is only
+enabled once a code is confirmed through /confirmTwoFactor
 Header: Authorization: <token>
 Body fields: none
-Response: 200 OK if successful, no body
+Response:
+	{ secret: <base32 secret>, uri: <otpauth:// provisioning URI, to be shown as a QR code> }
 */
-func clearTokensHandler(w http.ResponseWriter, r *http.Request) {
+func enableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
 	// Verify token
-	token := r.Header.Get("Authorization")
-	if !verifyToken(token) {
+	session, ok := authenticateRequest(r)
+	if !ok {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
+	if !requireSessionToken(w, session) {
+		return
+	}
 
-	// Delete all tokens
-	err := deleteAllTokens()
+	// Generate secret
+	user, err := findUserById(session.userId)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	secret, uri, err := beginTotpEnrollment(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(map[string]string{
+		"secret": secret,
+		"uri":    uri,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /confirmTwoFactor
+Confirm TOTP enrollment with a code from the authenticator app, which enables two-factor authentication
+Header: Authorization: <token>
+Body fields: code
+	code: the current TOTP code
+Response:
+	{ recoveryCodes: [<code>] }
+	The recovery codes can each be used once in place of a TOTP code. They are not shown again
+*/
+func confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var confirmInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&confirmInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(confirmInfo, []string{"code"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Enable two-factor authentication
+	recoveryCodes, err := confirmTotpEnrollment(session.userId, confirmInfo["code"].(string))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"recoveryCodes": recoveryCodes,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /disableTwoFactor
+Disable two-factor authentication
+Header: Authorization: <token>
+Body fields: code
+	code: the current TOTP code, or one of the recovery codes
+Response: 200 OK if successful, no body
+*/
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var disableInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&disableInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(disableInfo, []string{"code"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Verify the code
+	if !verifySecondFactor(session.userId, disableInfo["code"].(string)) {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	// Disable two-factor authentication
+	err = disableTotp(session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+POST /beginPasskeyRegistration
+Start registering a passkey (WebAuthn credential). The relying party ID is the host of the
+requesting origin, which must be one of the CORS_DOMAINS
+Header: Authorization: <token>
+Body fields: none
+Response:
+	{ publicKey: <PublicKeyCredentialCreationOptions> }
+	Binary fields (challenge, user.id, excludeCredentials[].id) are base64url encoded
+*/
+func beginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Get relying party ID
+	rpId, ok := getWebauthnOrigins()[r.Header.Get("Origin")]
+	if !ok {
+		http.Error(w, "Origin not allowed", http.StatusBadRequest)
+		return
+	}
+
+	user, err := findUserById(session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Exclude passkeys that are already registered
+	passkeys, err := getPasskeys(session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	excludeCredentials := make([]map[string]string, 0)
+	for _, passkey := range passkeys {
+		excludeCredentials = append(excludeCredentials, map[string]string{
+			"type": "public-key",
+			"id":   passkey.CredentialId,
+		})
+	}
+
+	challenge, err := generateWebauthnChallenge("register", session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge": challenge,
+			"rp": map[string]string{
+				"id":   rpId,
+				"name": "Ice Wallet",
+			},
+			"user": map[string]string{
+				"id":          base64.RawURLEncoding.EncodeToString(user.Id[:]),
+				"name":        user.Username,
+				"displayName": user.Username,
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": coseAlgES256},
+				{"type": "public-key", "alg": coseAlgRS256},
+			},
+			"excludeCredentials": excludeCredentials,
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+			"attestation": "none",
+			"timeout":     300000,
+		},
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /finishPasskeyRegistration
+Finish registering a passkey
+Header: Authorization: <token>
+Body fields: clientDataJSON, attestationObject, name
+	clientDataJSON: the response.clientDataJSON of the created credential, base64url encoded
+	attestationObject: the response.attestationObject of the created credential, base64url encoded
+	name: a name to recognize the passkey by
+Response:
+	{ id: <credential id>, name: <name>, ... }
+	409 Conflict if the passkey is already registered, by this or another user
+*/
+func finishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var registrationInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&registrationInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(registrationInfo, []string{"clientDataJSON", "attestationObject", "name"}, []string{"string", "string", "string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	clientDataJSON, err := decodeWebauthnBase64(registrationInfo["clientDataJSON"].(string))
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	attestationObject, err := decodeWebauthnBase64(registrationInfo["attestationObject"].(string))
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Verify the registration
+	credential, err := verifyPasskeyRegistration(clientDataJSON, attestationObject, getWebauthnOrigins(), func(challenge string) bool {
+		return consumeWebauthnChallenge(challenge, "register", session.userId)
+	})
+	if err != nil {
+		http.Error(w, "Invalid passkey: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	credential.UserId = session.userId
+	credential.Name = registrationInfo["name"].(string)
+
+	// Store the passkey
+	err = insertPasskey(credential)
+	if err == errPasskeyExists {
+		http.Error(w, "Passkey is already registered", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(credential)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /beginPasskeyLogin
+Start logging in with a passkey
+Header: none
+Body fields: username (optional)
+	username: if provided, only the passkeys of this user are allowed. Otherwise the
+		browser offers the discoverable passkeys it knows for the relying party
+Response:
+	{ publicKey: <PublicKeyCredentialRequestOptions> }
+	Binary fields (challenge, allowCredentials[].id) are base64url encoded
+*/
+func beginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	// Get relying party ID
+	rpId, ok := getWebauthnOrigins()[r.Header.Get("Origin")]
+	if !ok {
+		http.Error(w, "Origin not allowed", http.StatusBadRequest)
+		return
+	}
+
+	// Parse body, which is optional
+	var loginInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&loginInfo)
+	if err != nil && err != io.EOF {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Allow the user's passkeys registered for this relying party
+	allowCredentials := make([]map[string]string, 0)
+	userVerification := "preferred"
+	if username, ok := loginInfo["username"].(string); ok {
+		user, err := findUserByName(username)
+		if err == nil {
+			passkeys, err := getPasskeys(user.Id)
+			if err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			for _, passkey := range passkeys {
+				if passkey.RpId == rpId {
+					allowCredentials = append(allowCredentials, map[string]string{
+						"type": "public-key",
+						"id":   passkey.CredentialId,
+					})
+				}
+			}
+			if isTotpEnabled(user.Id) {
+				userVerification = "required"
+			}
+		}
+	}
+
+	challenge, err := generateWebauthnChallenge("login", primitive.NilObjectID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             rpId,
+			"allowCredentials": allowCredentials,
+			"userVerification": userVerification,
+			"timeout":          300000,
+		},
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /finishPasskeyLogin
+Finish logging in with a passkey and get a token
+Header: none
+Body fields: id, clientDataJSON, authenticatorData, signature
+	id: the credential id, base64url encoded
+	clientDataJSON: the response.clientDataJSON of the assertion, base64url encoded
+	authenticatorData: the response.authenticatorData of the assertion, base64url encoded
+	signature: the response.signature of the assertion, base64url encoded
+Response:
+	{ token: <token> }
+	429 Too Many Requests with a Retry-After header if the client is rate limited or locked out
+*/
+func finishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	// Check rate limits and lockout
+	clientIp := getClientIp(r)
+	if ok, retryAfter := checkLoginAllowed(clientIp); !ok {
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
+	// Parse body
+	var loginInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&loginInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(loginInfo, []string{"id", "clientDataJSON", "authenticatorData", "signature"}, []string{"string", "string", "string", "string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	var decoded [3][]byte
+	for i, field := range []string{"clientDataJSON", "authenticatorData", "signature"} {
+		decoded[i], err = decodeWebauthnBase64(loginInfo[field].(string))
+		if err != nil {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Find the passkey
+	credential, err := findPasskey(loginInfo["id"].(string))
+	if err != nil {
+		http.Error(w, "Invalid passkey", http.StatusBadRequest)
+		return
+	}
+
+	// Verify the assertion. With two-factor authentication enabled, the passkey
+	// replaces both factors, so the authenticator must have verified the user
+	signCount, err := verifyPasskeyAssertion(credential, decoded[0], decoded[1], decoded[2], getWebauthnOrigins(), func(challenge string) bool {
+		return consumeWebauthnChallenge(challenge, "login", primitive.NilObjectID)
+	}, isTotpEnabled(credential.UserId))
+	if err != nil {
+		err = recordLoginFailure(ipSubject(clientIp))
+		if err != nil {
+			log.Println("Failed to record login failure:", err)
+		}
+		http.Error(w, "Invalid passkey", http.StatusBadRequest)
+		return
+	}
+	err = updatePasskeyUsage(credential.CredentialId, signCount)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	err = clearLoginFailures(ipSubject(clientIp))
+	if err != nil {
+		log.Println("Failed to clear login failures:", err)
+	}
+
+	// Create token
+	var token string
+	token, err = generateToken(credential.UserId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]string{
+		"token": token,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /getPasskeys
+List registered passkeys
+Header: Authorization: <token>
+Body fields: none
+Response:
+	{ passkeys: [{ id, name, rpId, algorithm, createTime, lastUsed }] }
+*/
+func getPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	passkeys, err := getPasskeys(session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"passkeys": passkeys,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /deletePasskey
+Delete a registered passkey
+Header: Authorization: <token>
+Body fields: id
+	id: the credential id of the passkey
+Response: 200 OK if successful, no body
+*/
+func deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var deleteInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&deleteInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(deleteInfo, []string{"id"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	err = deletePasskey(session.userId, deleteInfo["id"].(string))
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+POST /logout
+Delete the token from the server
+Header: Authorization: <token>
+Body fields: none
+Response: 200 OK if successful, no body
+*/
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Delete token
+	err := deleteToken(session.token)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+POST /getPublicKey
+Obtain the server's public key
+Header: none
+Body fields: none
+Response:
+	{ publicKey: <public key> }
+*/
+func getPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	// Send public key
+	var publicKeyJson map[string]string
+	publicKeyJson = make(map[string]string)
+	publicKeyJson["key"] = publicKeyStr
+	err := json.NewEncoder(w).Encode(publicKeyJson)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /clearTokens
+Delete all tokens of the current user from the server
+Header: Authorization: <token>
+Body fields: none
+Response: 200 OK if successful, no body
+*/
+func clearTokensHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Delete all tokens
+	err := deleteAllTokens(session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	recordAuditEvent(r, session, AuditClearTokens, nil, nil, nil, nil)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+POST /getMonthlyReport
+Get monthly income and expense report for a given year. Months start at midnight in the user's timezone
+Header: Authorization: <token or API key>
+Body fields: year, filter, savedFilter, search, timezone, wallet
+	year: the year to get the report for (e.g., 2025)
+	filter (optional): an array of entryFilter objects limiting the entries in the report, see /getEntries
+	savedFilter (optional): the id of a saved filter whose filters are added to filter, see /getEntries
+	search (optional): words to search for, see /getEntries. A saved filter's search is used unless given
+	timezone (optional): the IANA timezone to group entries in, overriding the user's timezone
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
+Response:
+	{ monthlyData: [{ month: 1, income: 100.00, expense: 50.00 }, ...] }
+	Returns 12 months of data, with zero values for months with no entries
+*/
+func getMonthlyReportHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReportsOnly) {
+		return
+	}
+
+	// Parse body
+	var reportInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&reportInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Parse year - accept both string and number formats
+	var year int
+	if reportInfo["year"] == nil {
+		http.Error(w, "Missing year field", http.StatusBadRequest)
+		return
+	}
+	switch v := reportInfo["year"].(type) {
+	case float64:
+		year = int(v)
+	case string:
+		_, err := fmt.Sscanf(v, "%d", &year)
+		if err != nil {
+			http.Error(w, "Invalid year format", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Invalid year type", http.StatusBadRequest)
+		return
+	}
+
+	// Validate year range (reasonable bounds)
+	if year < 1900 || year > 2100 {
+		http.Error(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	// Parse filter and check permission
+	query, location, ok := parseReportQuery(w, session, reportInfo)
+	if !ok {
+		return
+	}
+
+	// Get monthly report
+	monthlyData, err := getMonthlyReport(query, year, location)
+	if err != nil {
+		writeReportError(w, err)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"monthlyData": monthlyData,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /getReport
+Get the income and expense of each day, week, month, quarter or year of a date range.
+Periods start at midnight in the user's timezone, and weeks are ISO weeks starting on Monday
+Header: Authorization: <token or API key>
+Body fields: period, range, from, to, filter, savedFilter, search, timezone, wallet
+	period: "day", "week", "month", "quarter" or "year"
+	range: a relative period such as "this-year" or "last-quarter", see /getEntries. Either range or from and to must be given
+	from: the start of the range, an RFC3339 or relative date
+	to: the end of the range, excluded. A relative period such as "this-month" ends the range at its end
+	filter (optional): an array of entryFilter objects limiting the entries in the report, see /getEntries
+	savedFilter (optional): the id of a saved filter whose filters are added to filter, see /getEntries
+	search (optional): words to search for, see /getEntries. A saved filter's search is used unless given
+	timezone (optional): the IANA timezone periods start in, overriding the user's timezone
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
+Response:
+	{ buckets: [{ start, label, income, expense, net, count }], income, expense, net, count, from, to, timezone }
+	Periods without entries have zero values. Labels look like "2025-03-14", "2025-W11", "2025-03", "2025-Q1" or "2025"
+	400 Bad Request if the range has more than 1000 periods
+*/
+func getReportHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReportsOnly) {
+		return
+	}
+
+	// Parse body
+	var reportInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&reportInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(reportInfo, []string{"period"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	period := reportInfo["period"].(string)
+	if _, valid := periodKeyFormats[period]; !valid {
+		http.Error(w, "Invalid period", http.StatusBadRequest)
+		return
+	}
+
+	// Parse filter and check permission
+	query, location, ok := parseReportQuery(w, session, reportInfo)
+	if !ok {
+		return
+	}
+	from, to, ok := parseReportRange(w, reportInfo, location)
+	if !ok {
+		return
+	}
+
+	// Get report
+	buckets, err := getPeriodReport(query, from, to, period, location)
+	if err != nil {
+		writeReportError(w, err)
+		return
+	}
+
+	var income, expense float64
+	var count int64
+	for _, bucket := range buckets {
+		income += bucket.Income
+		expense += bucket.Expense
+		count += bucket.Count
+	}
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"buckets":  buckets,
+		"income":   income,
+		"expense":  expense,
+		"net":      income - expense,
+		"count":    count,
+		"from":     from,
+		"to":       to,
+		"timezone": location.String(),
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /getBreakdownReport
+Get where the money went in a date range: the largest descriptions or categories by total, with the rest
+grouped as "Other", each compared with the previous equivalent period
+Header: Authorization: <token or API key>
+Body fields: dimension, flow, limit, range, from, to, filter, savedFilter, search, timezone, wallet
+	dimension: "description" or "category"
+	flow (optional): "expense" or "income", defaults to expense
+	limit (optional): the number of items before "Other", from 1 to 50, defaults to 10
+	range, from, to: the date range, see /getReport. The previous period has the same length and ends where
+		the range starts. Ranges of whole months, such as "last-month", are compared with the same number of months before
+	filter, savedFilter, search, timezone, wallet (optional): see /getReport
+Response:
+	{ items: [item], other: item, total, count, previousTotal, from, to, previousFrom, previousTo, timezone }
+	item: { key, total, count, share, previousTotal, change, changePercent }
+	Totals are positive for both flows. key is empty for entries without a category. share is the fraction
+	of the total from 0 to 1. changePercent is null if the previous total is zero. other is null if there are no more items
+*/
+func getBreakdownReportHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReportsOnly) {
+		return
+	}
+
+	// Parse body
+	var reportInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&reportInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(reportInfo, []string{"dimension"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	dimension := reportInfo["dimension"].(string)
+	if _, valid := breakdownDimensions[dimension]; !valid {
+		http.Error(w, "Invalid dimension", http.StatusBadRequest)
+		return
+	}
+	flow := FlowExpense
+	if reportInfo["flow"] != nil {
+		flow, _ = reportInfo["flow"].(string)
+		if flow != FlowExpense && flow != FlowIncome {
+			http.Error(w, "Invalid flow", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultBreakdownLimit
+	if reportInfo["limit"] != nil {
+		limitValue, isNumber := reportInfo["limit"].(float64)
+		if !isNumber || limitValue < 1 || limitValue > maxBreakdownLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = int(limitValue)
+	}
+
+	// Parse filter and check permission
+	query, location, ok := parseReportQuery(w, session, reportInfo)
+	if !ok {
+		return
+	}
+	from, to, ok := parseReportRange(w, reportInfo, location)
+	if !ok {
+		return
+	}
+
+	// Get report
+	report, err := getBreakdownReport(query, from.In(location), to.In(location), dimension, flow, limit)
+	if err != nil {
+		writeReportError(w, err)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"items":         report.Items,
+		"other":         report.Other,
+		"total":         report.Total,
+		"count":         report.Count,
+		"previousTotal": report.PreviousTotal,
+		"from":          from,
+		"to":            to,
+		"previousFrom":  report.PreviousFrom,
+		"previousTo":    report.PreviousTo,
+		"timezone":      location.String(),
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /getComparisonReport
+Compare the expense or income of a date range with the previous period or with the same dates a year earlier,
+side by side for each period and each category
+Header: Authorization: <token or API key>
+Body fields: period, compareTo, flow, range, from, to, filter, savedFilter, search, timezone, wallet
+	period: "day", "week", "month", "quarter" or "year"
+	compareTo (optional): "previous" for the previous period of the same length, see /getBreakdownReport,
+		or "previous-year" for the same dates a year earlier. Defaults to previous-year
+	flow (optional): "expense" or "income", defaults to expense
+	range, from, to, filter, savedFilter, search, timezone, wallet: see /getReport
+Response:
+	{ buckets: [row], categories: [row], total: row, from, to, compareFrom, compareTo, timezone }
+	row: { key, compareKey, current, previous, change, changePercent, unusual }
+	Periods are aligned by position: key is the label of the period and compareKey the label of the period it is
+	compared with. For categories, key is the category, empty for entries without one. changePercent is null if
+	previous is zero. unusual is true if the change stands out from the changes of the other rows, using the
+	modified z-score of the changes, and is never set with fewer than 4 rows
+*/
+func getComparisonReportHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReportsOnly) {
+		return
+	}
+
+	// Parse body
+	var reportInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&reportInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(reportInfo, []string{"period"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	period := reportInfo["period"].(string)
+	if _, valid := periodKeyFormats[period]; !valid {
+		http.Error(w, "Invalid period", http.StatusBadRequest)
+		return
+	}
+	compareTo := CompareToPreviousYear
+	if reportInfo["compareTo"] != nil {
+		compareTo, _ = reportInfo["compareTo"].(string)
+		if compareTo != CompareToPrevious && compareTo != CompareToPreviousYear {
+			http.Error(w, "Invalid compareTo", http.StatusBadRequest)
+			return
+		}
+	}
+	flow := FlowExpense
+	if reportInfo["flow"] != nil {
+		flow, _ = reportInfo["flow"].(string)
+		if flow != FlowExpense && flow != FlowIncome {
+			http.Error(w, "Invalid flow", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Parse filter and check permission
+	query, location, ok := parseReportQuery(w, session, reportInfo)
+	if !ok {
+		return
+	}
+	from, to, ok := parseReportRange(w, reportInfo, location)
+	if !ok {
+		return
+	}
+
+	// Get report
+	report, err := getComparisonReport(query, from.In(location), to.In(location), period, compareTo, flow, location)
+	if err != nil {
+		writeReportError(w, err)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"buckets":     report.Buckets,
+		"categories":  report.Categories,
+		"total":       report.Total,
+		"from":        from,
+		"to":          to,
+		"compareFrom": report.CompareFrom,
+		"compareTo":   report.CompareTo,
+		"timezone":    location.String(),
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /getForecast
+Project the balance of a wallet for the next days, to see whether it will go negative. The projection adds the entries
+already dated in the future and the entries detected to recur: entries with the same description, ignoring case,
+that appear at least 3 times at a weekly, biweekly, monthly, quarterly or yearly interval with similar amounts
+Header: Authorization: <token or API key>
+Body fields: days, historyDays, filter, savedFilter, search, timezone, wallet
+	days (optional): the number of days to project, from 1 to 365, defaults to 30
+	historyDays (optional): the number of past days to detect recurring entries in, from 30 to 1095, defaults to 365.
+		Yearly entries need a history of over 2 years
+	filter, savedFilter, search, timezone, wallet (optional): see /getReport
+Response:
+	{ recurring: [{ description, amount, cadence, occurrences, lastDate, nextDate }],
+	  points: [{ date, label, balance, known, projected, items }], openingBalance, lowestBalance, lowestDate, firstNegativeDate, timezone }
+	points has one point per day starting today, with the balance at the end of the day. known is the net of the entries
+	already dated on that day, projected the net of the recurring entries due that day, and items their descriptions.
+	Recurring entries that are late are projected today, and those missing for more than one and a half intervals are
+	considered stopped. firstNegativeDate is null if the balance stays positive
+*/
+func getForecastHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReportsOnly) {
+		return
+	}
+
+	// Parse body
+	var forecastInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&forecastInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	days := 30
+	if forecastInfo["days"] != nil {
+		value, isNumber := forecastInfo["days"].(float64)
+		if !isNumber || value < 1 || value > 365 {
+			http.Error(w, "Invalid days", http.StatusBadRequest)
+			return
+		}
+		days = int(value)
+	}
+	historyDays := 365
+	if forecastInfo["historyDays"] != nil {
+		value, isNumber := forecastInfo["historyDays"].(float64)
+		if !isNumber || value < 30 || value > 1095 {
+			http.Error(w, "Invalid historyDays", http.StatusBadRequest)
+			return
+		}
+		historyDays = int(value)
+	}
+
+	// Parse filter and check permission
+	query, location, ok := parseReportQuery(w, session, forecastInfo)
+	if !ok {
+		return
+	}
+
+	// Get forecast
+	forecast, err := getCashFlowForecast(query, days, historyDays, location)
+	if err != nil {
+		writeReportError(w, err)
+		return
+	}
+
+	lowestBalance := forecast.OpeningBalance
+	var lowestDate, firstNegativeDate *time.Time
+	for i, point := range forecast.Points {
+		if lowestDate == nil || point.Balance < lowestBalance {
+			lowestBalance = point.Balance
+			lowestDate = &forecast.Points[i].Date
+		}
+		if firstNegativeDate == nil && point.Balance < 0 {
+			firstNegativeDate = &forecast.Points[i].Date
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"recurring":         forecast.Recurring,
+		"points":            forecast.Points,
+		"openingBalance":    forecast.OpeningBalance,
+		"lowestBalance":     lowestBalance,
+		"lowestDate":        lowestDate,
+		"firstNegativeDate": firstNegativeDate,
+		"timezone":          location.String(),
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// The maximum number of wallets of a balance report
+const maxBalanceWallets = 20
+
+/*
+POST /getBalanceReport
+Get the running balance at the end of each day, week, month, quarter or year of a date range, for drawing
+a net worth chart. The balance includes all entries before the range
+Header: Authorization: <token or API key>
+Body fields: period, range, from, to, wallets, filter, savedFilter, search, timezone, wallet
+	period: "day", "week", "month", "quarter" or "year"
+	range, from, to: the date range, see /getReport
+	wallets (optional): an array of up to 20 wallet ids, or "all" for every wallet of the user.
+		Defaults to the wallet field
+	filter, savedFilter, search, timezone, wallet (optional): see /getReport
+Response:
+	{ overall: series, wallets: [series], from, to, timezone }
+	series: { wallet, opening, points: [{ start, label, net, balance }] }
+	opening is the balance before the range, and balance is the balance at the end of each period.
+	overall combines all wallets, and has no wallet field
+	403 Forbidden if the user cannot view one of the wallets
+*/
+func getBalanceReportHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReportsOnly) {
+		return
+	}
+
+	// Parse body
+	var reportInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&reportInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(reportInfo, []string{"period"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	period := reportInfo["period"].(string)
+	if _, valid := periodKeyFormats[period]; !valid {
+		http.Error(w, "Invalid period", http.StatusBadRequest)
+		return
+	}
+	filters, location, ok := parseReportFilters(w, session, reportInfo)
+	if !ok {
+		return
+	}
+	from, to, ok := parseReportRange(w, reportInfo, location)
+	if !ok {
+		return
+	}
+
+	// Check permission
+	var walletIds []primitive.ObjectID
+	if reportInfo["wallets"] == "all" {
+		wallets, err := getUserWallets(session.userId)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for _, wal := range wallets {
+			walletIds = append(walletIds, wal.Id)
+		}
+	} else if reportInfo["wallets"] != nil {
+		walletIdStrs, isList := parseStringList(reportInfo["wallets"])
+		if !isList || len(walletIdStrs) == 0 {
+			http.Error(w, "Invalid wallets", http.StatusBadRequest)
+			return
+		}
+		for _, walletIdStr := range walletIdStrs {
+			walletId, ok := authorizeWalletRequest(w, session, map[string]interface{}{"wallet": walletIdStr}, RoleViewer)
+			if !ok {
+				return
+			}
+			walletIds = append(walletIds, walletId)
+		}
+	} else {
+		walletId, ok := authorizeWalletRequest(w, session, reportInfo, RoleViewer)
+		if !ok {
+			return
+		}
+		walletIds = append(walletIds, walletId)
+	}
+	if len(walletIds) > maxBalanceWallets {
+		http.Error(w, "Too many wallets", http.StatusBadRequest)
+		return
+	}
+
+	// Get the series of each wallet
+	series := make([]balanceSeries, 0, len(walletIds))
+	for i := range walletIds {
+		query, ok := buildSearchQuery(w, walletIds[i], filters, reportInfo)
+		if !ok {
+			return
+		}
+		walletSeries, err := getBalanceSeries(query, from, to, period, location)
+		if err != nil {
+			writeReportError(w, err)
+			return
+		}
+		walletSeries.Wallet = &walletIds[i]
+		series = append(series, walletSeries)
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"overall":  combineBalanceSeries(series),
+		"wallets":  series,
+		"from":     from,
+		"to":       to,
+		"timezone": location.String(),
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getWalletMembersInfo returns the members of a wallet with their usernames
+func getWalletMembersInfo(wal wallet) []map[string]interface{} {
+	members := make([]map[string]interface{}, 0)
+	for _, member := range wal.Members {
+		username := ""
+		user, err := findUserById(member.UserId)
+		if err == nil {
+			username = user.Username
+		}
+		members = append(members, map[string]interface{}{
+			"user":     member.UserId,
+			"username": username,
+			"role":     member.Role,
+		})
+	}
+	return members
+}
+
+/*
+POST /getWallets
+Get the wallets the user is a member of
+Header: Authorization: <token or API key>
+Body fields: none
+Response:
+	{ wallets: [{ id, name, personal, role, members: [{ user, username, role }], createTime }] }
+	personal is true for the user's own personal wallet, used when a request does not specify a wallet
+	403 Forbidden if an API key grants none of the read scopes
+*/
+func getWalletsHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReportsOnly) {
+		return
+	}
+
+	wallets, err := getUserWallets(session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]map[string]interface{}, 0)
+	for _, wal := range wallets {
+		results = append(results, map[string]interface{}{
+			"id":         wal.Id,
+			"name":       wal.Name,
+			"personal":   wal.PersonalOf != nil && *wal.PersonalOf == session.userId,
+			"role":       getMemberRole(wal, session.userId),
+			"members":    getWalletMembersInfo(wal),
+			"createTime": wal.CreateTime,
+		})
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"wallets": results,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /createWallet
+Create a wallet, owned by the user
+Header: Authorization: <token>
+Body fields: name
+	name: the name of the wallet
+Response:
+	{ id: <wallet id> }
+*/
+func createWalletHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var walletInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&walletInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(walletInfo, []string{"name"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Create wallet
+	walletId, err := createWallet(session.userId, walletInfo["name"].(string), false)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id": walletId,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /createInvitation
+Create a single-use invitation code to join a wallet. Only owners can invite
+Header: Authorization: <token>
+Body fields: wallet, role
+	wallet: the id of the wallet
+	role: the role of the invited user, "viewer" or "editor"
+Response:
+	{ code: <invitation code>, expires: <expiry time> }
+	The code is valid for 7 days
+*/
+func createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var invitationInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&invitationInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(invitationInfo, []string{"wallet", "role"}, []string{"string", "string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, invitationInfo, RoleOwner)
+	if !ok {
+		return
+	}
+
+	// Create invitation
+	code, expires, err := createInvitation(walletId, invitationInfo["role"].(string), session.userId)
+	if err != nil {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    code,
+		"expires": expires,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /acceptInvitation
+Join a wallet with an invitation code
+Header: Authorization: <token>
+Body fields: code
+	code: the invitation code
+Response:
+	{ wallet: <wallet id> }
+*/
+func acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var acceptInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&acceptInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(acceptInfo, []string{"code"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Join wallet
+	walletId, err := acceptInvitation(session.userId, acceptInfo["code"].(string))
+	if err != nil {
+		http.Error(w, "Invalid or expired invitation", http.StatusBadRequest)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"wallet": walletId,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /setWalletMember
+Change the role of a wallet member, or remove the member. Only owners can change other members,
+while any member can leave a wallet by removing themselves. A wallet always keeps at least one owner
+Header: Authorization: <token>
+Body fields: wallet, username, role
+	wallet: the id of the wallet
+	username: the username of the member
+	role: the new role, "viewer", "editor" or "owner". An empty string removes the member
+Response: 200 OK if successful, no body
+*/
+func setWalletMemberHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var memberInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&memberInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(memberInfo, []string{"wallet", "username", "role"}, []string{"string", "string", "string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	role := memberInfo["role"].(string)
+	if _, exists := roleRanks[role]; !exists && role != "" {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	member, err := findUserByName(memberInfo["username"].(string))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Check permission. Members can remove themselves
+	requiredRole := RoleOwner
+	if member.Id == session.userId && role == "" {
+		requiredRole = RoleViewer
+	}
+	walletId, ok := authorizeWalletRequest(w, session, memberInfo, requiredRole)
+	if !ok {
+		return
+	}
+
+	// Update member
+	err = setMemberRole(walletId, member.Id, role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseStringList reads an optional array of strings from the request body
+func parseStringList(value interface{}) ([]string, bool) {
+	if value == nil {
+		return []string{}, true
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	results := make([]string, 0, len(items))
+	for _, item := range items {
+		str, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		results = append(results, str)
+	}
+	return results, true
+}
+
+/*
+POST /createApiKey
+Create an API key for scripts and integrations. The key is only returned once
+Header: Authorization: <token>
+Body fields: name, scopes, expires, ipAllowlist
+	name: a name to recognize the key by
+	scopes: an array of scopes, "read-entries", "write-entries" or "reports-only"
+	expires (optional): the expiry time of the key in RFC3339 format, the key does not expire if omitted
+	ipAllowlist (optional): an array of IPs or CIDR ranges allowed to use the key, any IP if omitted
+Response:
+	{ id: <key id>, key: <API key> }
+	The key is sent in the Authorization header like a token
+*/
+func createApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var keyInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&keyInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(keyInfo, []string{"name", "scopes"}, []string{"string", "[]interface {}"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	scopes, ok := parseStringList(keyInfo["scopes"])
+	if !ok {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	ipAllowlist, ok := parseStringList(keyInfo["ipAllowlist"])
+	if !ok {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	var expires *time.Time
+	if keyInfo["expires"] != nil {
+		expiresStr, isString := keyInfo["expires"].(string)
+		t, err := time.Parse(time.RFC3339, expiresStr)
+		if !isString || err != nil {
+			http.Error(w, "Invalid expiry time", http.StatusBadRequest)
+			return
+		}
+		expires = &t
+	}
+
+	// Create key
+	key, plainKey, err := createApiKey(session.userId, keyInfo["name"].(string), scopes, expires, ipAllowlist)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":  key.Id,
+		"key": plainKey,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /getApiKeys
+Get the API keys of the current user. The keys themselves are not returned
+Header: Authorization: <token>
+Body fields: none
+Response:
+	{ apiKeys: [{ id, name, hint, scopes, expires, ipAllowlist, createTime, lastUsed }] }
+*/
+func getApiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	keys, err := getApiKeys(session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"apiKeys": keys,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /revokeApiKey
+Revoke an API key of the current user
+Header: Authorization: <token>
+Body fields: id
+	id: the id of the key
+Response: 200 OK if successful, no body
+	404 Not Found if the key does not exist
+*/
+func revokeApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var keyInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&keyInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(keyInfo, []string{"id"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Revoke key
+	err = revokeApiKey(session.userId, keyInfo["id"].(string))
+	if err != nil {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+POST /getAuditLog
+Get the audit log, newest first. Without a wallet, returns the changes made by the current user.
+With a wallet, returns all changes to the wallet's entries, which only owners can see
+Header: Authorization: <token>
+Body fields: start, limit, wallet
+	start: the index of the first event to return
+	limit: the maximum number of events to return. Cannot be greater than 100
+	wallet (optional): the id of the wallet
+Response:
+	{ events: [{ id, action, route, user, tokenId, apiKeyId, clientIp, wallet, entryId, before, after, time }], count: <number of events> }
+	before and after are the entry before and after the change. before is null for created entries, and both are null for account changes
+*/
+func getAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var logInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&logInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(logInfo, []string{"start", "limit"}, []string{"float64", "float64"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	var start = int64(logInfo["start"].(float64))
+	var limit = int64(logInfo["limit"].(float64))
+	if limit > 100 || limit < 0 || start < 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Check permission
+	query := bson.M{"user": session.userId}
+	if walletIdStr, _ := logInfo["wallet"].(string); walletIdStr != "" {
+		walletId, ok := authorizeWalletRequest(w, session, logInfo, RoleOwner)
+		if !ok {
+			return
+		}
+		query = bson.M{"wallet": walletId}
+	}
+
+	// Find events
+	events, count, err := findAuditEvents(query, start, limit)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": events,
+		"count":  count,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /getTrash
+Get the trashed entries of a wallet, most recently deleted first
+Header: Authorization: <token or API key>
+Body fields: start, limit, wallet
+	start: the index of the first entry to return
+	limit: the maximum number of entries to return. Cannot be greater than 100
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
+Response:
+	{ entries: [entry], count: <number of trashed entries> }
+	Each entry has a deletedAt field
+*/
+func getTrashHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReadEntries) {
+		return
+	}
+
+	// Parse body
+	var trashInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&trashInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(trashInfo, []string{"start", "limit"}, []string{"float64", "float64"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	var start = int64(trashInfo["start"].(float64))
+	var limit = int64(trashInfo["limit"].(float64))
+	if limit > 100 || limit < 0 || start < 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, trashInfo, RoleViewer)
+	if !ok {
+		return
+	}
+
+	// Find trashed entries
+	entries, count, err := findTrashedEntries(walletId, start, limit)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"count":   count,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /restoreEntry
+Restore an entry from the trash
+Header: Authorization: <token or API key>
+Body fields: id, wallet
+	id: the id of the entry to restore
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
+Response: 200 OK if successful, no body
+	403 Forbidden if the user is not an editor or owner of the wallet
+	404 Not Found if the entry is not in the trash
+*/
+func restoreEntryHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeWriteEntries) {
+		return
+	}
+
+	// Parse body
+	var restoreInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&restoreInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(restoreInfo, []string{"id"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, restoreInfo, RoleEditor)
+	if !ok {
+		return
+	}
+
+	// Restore entry
+	before, after, err := restoreEntry(walletId, restoreInfo["id"].(string))
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Entry not found in trash", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	entryId := before["_id"].(primitive.ObjectID)
+	recordRevision(walletId, entryId, session.userId, RevisionRestore, before, after)
+	recordAuditEvent(r, session, AuditRestoreEntry, &walletId, &entryId, before, after)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+GET /getEntryHistory?id=<entry id>&wallet=<wallet id>
+Get every revision of an entry, oldest first
+Header: Authorization: <token or API key>
+Query parameters: id, wallet
+	id: the id of the entry
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
+Response:
+	{ revisions: [{ id, entry, wallet, revision, action, user, before, after, time, undone }] }
+	action is "create", "update", "delete" or "restore". before is null for the creation of the entry
+	revision is the version of the entry after the change. Undone changes leave gaps in the numbers
+*/
+func getEntryHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReadEntries) {
+		return
+	}
+
+	// Parse query
+	query := r.URL.Query()
+	entryId := query.Get("id")
+	if entryId == "" {
+		http.Error(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, map[string]interface{}{"wallet": query.Get("wallet")}, RoleViewer)
+	if !ok {
+		return
+	}
+
+	// Find revisions
+	revisions, err := findEntryRevisions(walletId, entryId)
+	if err != nil {
+		http.Error(w, "Invalid entry id", http.StatusBadRequest)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"revisions": revisions,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 }
 
 /*
-POST /getMonthlyReport
-Get monthly income and expense report for a given year
-Header: Authorization: <token>
-Body fields: year
-	year: the year to get the report for (e.g., 2025)
+POST /undoChanges
+Revert the last changes to the entries of a wallet, across all entries. The changes are reverted
+all or nothing when the database is a replica set. Undone changes are skipped by later undos
+Header: Authorization: <token or API key>
+Body fields: count, wallet
+	count: the number of changes to undo, from 1 to 100
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
 Response:
-	{ monthlyData: [{ month: 1, income: 100.00, expense: 50.00 }, ...] }
-	Returns 12 months of data, with zero values for months with no entries
+	{ undone: [revision] }
+	403 Forbidden if the user is not an editor or owner of the wallet
 */
-func getMonthlyReportHandler(w http.ResponseWriter, r *http.Request) {
+func undoChangesHandler(w http.ResponseWriter, r *http.Request) {
 	// Verify token
-	token := r.Header.Get("Authorization")
-	if !verifyToken(token) {
+	session, ok := authenticateRequest(r)
+	if !ok {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
+	if !authorizeScope(w, session, ScopeWriteEntries) {
+		return
+	}
 
 	// Parse body
-	var reportInfo map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&reportInfo)
+	var undoInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&undoInfo)
 	if err != nil {
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
+	if !checkBodyFields(undoInfo, []string{"count"}, []string{"float64"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	count := int64(undoInfo["count"].(float64))
+	if count <= 0 || count > maxUndoCount {
+		http.Error(w, "Invalid count", http.StatusBadRequest)
+		return
+	}
 
-	// Parse year - accept both string and number formats
-	var year int
-	if reportInfo["year"] == nil {
-		http.Error(w, "Missing year field", http.StatusBadRequest)
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, undoInfo, RoleEditor)
+	if !ok {
 		return
 	}
-	switch v := reportInfo["year"].(type) {
-	case float64:
-		year = int(v)
-	case string:
-		_, err := fmt.Sscanf(v, "%d", &year)
+
+	// Undo changes
+	undone, err := undoChanges(walletId, count)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, rev := range undone {
+		entryId := rev.EntryId
+		recordAuditEvent(r, session, AuditUndoChange, &walletId, &entryId, rev.After, rev.Before)
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"undone": undone,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /bulkEntries
+Update, delete or tag many entries at once, selected by ids or by the same filter as /getEntries.
+All changes are made in one transaction when the database is a replica set
+Header: Authorization: <token or API key>
+Body fields: operation, ids, filter, savedFilter, search, changes, addTags, removeTags, dryRun, wallet
+	operation: "update", "delete" or "tag"
+	ids: an array of entry ids. Either ids or filter must be given
+	filter: an array of entryFilter objects, see /getEntries
+	savedFilter (optional): the id of a saved filter whose filters are added to filter, see /getEntries
+	search (optional): words to search for with filter, see /getEntries. A saved filter's search is used unless given
+	timezone (optional): the timezone relative dates are resolved in, see /getEntries
+	changes: for update, the fields to change, see /updateEntry
+	addTags, removeTags: for tag, arrays of tags to add to and remove from each entry
+	dryRun (optional): if true, only return the entries that would be changed
+	wallet (optional): the id of the wallet, defaults to the user's personal wallet
+Response:
+	{ dryRun: <dry run>, count: <number of entries changed, or matched for a dry run>, results: [{ id, status, version, error }] }
+	status is "matched" for a dry run, otherwise "updated", "deleted", "notFound", "conflict" or "failed"
+	400 Bad Request if more than 1000 entries are selected, or the filter takes too long
+*/
+func bulkEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeWriteEntries) {
+		return
+	}
+
+	// Parse body
+	var bulkInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&bulkInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(bulkInfo, []string{"operation"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !resolveSavedFilter(w, session, bulkInfo) {
+		return
+	}
+	if _, ok = resolveTimezone(w, session, bulkInfo); !ok {
+		return
+	}
+	dryRun, _ := bulkInfo["dryRun"].(bool)
+
+	op := bulkOperation{Operation: bulkInfo["operation"].(string)}
+	switch op.Operation {
+	case BulkUpdate:
+		changes, isObject := bulkInfo["changes"].(map[string]interface{})
+		if !isObject {
+			http.Error(w, "Invalid changes", http.StatusBadRequest)
+			return
+		}
+		op.Changes, op.Cleared, err = parseEntryChanges(changes, nil)
 		if err != nil {
-			http.Error(w, "Invalid year format", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(op.Changes) == 0 && len(op.Cleared) == 0 {
+			http.Error(w, "No fields to update", http.StatusBadRequest)
 			return
 		}
+	case BulkTag:
+		op.AddTags, ok = parseStringList(bulkInfo["addTags"])
+		if ok {
+			op.RemoveTags, ok = parseStringList(bulkInfo["removeTags"])
+		}
+		if !ok || len(op.AddTags)+len(op.RemoveTags) == 0 {
+			http.Error(w, "Invalid tags", http.StatusBadRequest)
+			return
+		}
+	case BulkDelete:
 	default:
-		http.Error(w, "Invalid year type", http.StatusBadRequest)
+		http.Error(w, "Invalid operation", http.StatusBadRequest)
 		return
 	}
 
-	// Validate year range (reasonable bounds)
-	if year < 1900 || year > 2100 {
-		http.Error(w, "Invalid year", http.StatusBadRequest)
+	// Check permission
+	walletId, ok := authorizeWalletRequest(w, session, bulkInfo, RoleEditor)
+	if !ok {
 		return
 	}
 
-	// Get monthly report
-	monthlyData, err := getMonthlyReport(year)
+	// Select entries by ids or by filter
+	var ids []string
+	var query map[string]interface{}
+	if bulkInfo["ids"] != nil {
+		ids, ok = parseStringList(bulkInfo["ids"])
+		if !ok || bulkInfo["filter"] != nil || bulkInfo["search"] != nil {
+			http.Error(w, "Either ids or filter must be given", http.StatusBadRequest)
+			return
+		}
+	} else if _, isArray := bulkInfo["filter"].([]interface{}); isArray {
+		filters, err := parseFiltersFromHttpBody(bulkInfo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query, ok = buildSearchQuery(w, walletId, filters, bulkInfo)
+		if !ok {
+			return
+		}
+	} else {
+		http.Error(w, "Either ids or filter must be given", http.StatusBadRequest)
+		return
+	}
+
+	// Apply the operation
+	results, err := runBulkOperation(walletId, ids, query, op, dryRun)
+	if err == errTooManyBulkEntries {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if isQueryTimeout(err) {
+		http.Error(w, "Filter took too long, try a simpler regular expression", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	count := 0
+	for _, result := range results {
+		switch result.Status {
+		case BulkStatusMatched:
+			count++
+		case BulkStatusUpdated, BulkStatusDeleted:
+			count++
+			entryId := result.before["_id"].(primitive.ObjectID)
+			if result.Status == BulkStatusDeleted {
+				recordRevision(walletId, entryId, session.userId, RevisionDelete, result.before, result.after)
+				recordAuditEvent(r, session, AuditDeleteEntry, &walletId, &entryId, result.before, result.after)
+			} else {
+				recordRevision(walletId, entryId, session.userId, RevisionUpdate, result.before, result.after)
+				recordAuditEvent(r, session, AuditUpdateEntry, &walletId, &entryId, result.before, result.after)
+			}
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"dryRun":  dryRun,
+		"count":   count,
+		"results": results,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /createSavedFilter
+Save a filter preset, which /getEntries, /bulkEntries and the reports accept as savedFilter
+Header: Authorization: <token>
+Body fields: name, filter, sort, search
+	name: a name to recognize the filter by
+	filter: an array of entryFilter objects, see /getEntries. Relative dates such as "now-90d" are
+		resolved each time the filter is used
+	sort (optional): the sort, see /getEntries
+	search (optional): words to search for, see /getEntries
+Response:
+	{ id: <saved filter id> }
+	400 Bad Request if the filter is invalid
+*/
+func createSavedFilterHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var filterInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&filterInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(filterInfo, []string{"name", "filter"}, []string{"string", "[]interface {}"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	search, _ := filterInfo["search"].(string)
+
+	// Save filter
+	saved, err := createSavedFilter(session.userId, filterInfo["name"].(string), filterInfo["filter"].([]interface{}), filterInfo["sort"], search)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id": saved.Id,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /getSavedFilters
+Get the saved filters of the current user
+Header: Authorization: <token or API key>
+Body fields: none
+Response:
+	{ savedFilters: [{ id, name, filter, sort, search, createTime }] }
+*/
+func getSavedFiltersHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReportsOnly) {
+		return
+	}
+
+	filters, err := getSavedFilters(session.userId)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	err = json.NewEncoder(w).Encode(map[string]interface{}{
-		"monthlyData": monthlyData,
+		"savedFilters": filters,
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+POST /deleteSavedFilter
+Delete a saved filter of the current user
+Header: Authorization: <token>
+Body fields: id
+	id: the id of the saved filter
+Response: 200 OK if successful, no body
+	404 Not Found if the saved filter does not exist
+*/
+func deleteSavedFilterHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var filterInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&filterInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(filterInfo, []string{"id"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Delete filter
+	err = deleteSavedFilter(session.userId, filterInfo["id"].(string))
+	if err != nil {
+		http.Error(w, "Saved filter not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+POST /getSettings
+Get the settings of the current user
+Header: Authorization: <token or API key>
+Body fields: none
+Response:
+	{ timezone: <IANA timezone, empty for the server default>, effectiveTimezone: <timezone in use> }
+	403 Forbidden if an API key grants none of the read scopes
+*/
+func getSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !authorizeScope(w, session, ScopeReportsOnly) {
+		return
+	}
+
+	settings, err := findUserSettings(session.userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	location, err := findUserLocation(session.userId, nil)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"timezone":          settings.Timezone,
+		"effectiveTimezone": location.String(),
 	})
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 }
+
+/*
+POST /updateSettings
+Change the settings of the current user
+Header: Authorization: <token>
+Body fields: timezone
+	timezone: the IANA timezone reports and relative dates use, such as "America/Toronto",
+		or an empty string for the server default
+Response: 200 OK if successful, no body
+	400 Bad Request if the timezone is unknown
+*/
+func updateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	// Verify token
+	session, ok := authenticateRequest(r)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !requireSessionToken(w, session) {
+		return
+	}
+
+	// Parse body
+	var settingsInfo map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&settingsInfo)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !checkBodyFields(settingsInfo, []string{"timezone"}, []string{"string"}) {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Update settings
+	err = setUserTimezone(session.userId, settingsInfo["timezone"].(string))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
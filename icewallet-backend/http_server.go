@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -11,17 +12,23 @@ var corsAllowRoutes = map[string]bool{
 	"/getPublicKey": true,
 }
 
+// isApiKeyRequest checks whether the request comes from a script using an API key.
+// Such requests are not made by browsers and carry no Origin header
+func isApiKeyRequest(r *http.Request) bool {
+	return r.Header.Get("Origin") == "" && strings.HasPrefix(r.Header.Get("Authorization"), apiKeyPrefix)
+}
+
 func addHttpRoute(method string, path string, handler http.HandlerFunc) {
 	if method == "GET" {
 		http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 			// Check if domain is allowed
-			if !corsDomains[r.Header.Get("Origin")] && !corsAllowRoutes[path] {
+			if !corsDomains[r.Header.Get("Origin")] && !corsAllowRoutes[path] && !isApiKeyRequest(r) {
 				w.WriteHeader(http.StatusForbidden)
 				return
 			} else {
 				w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 				w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
 				if r.Method == "OPTIONS" {
 					w.WriteHeader(http.StatusOK)
 					return
@@ -38,13 +45,13 @@ func addHttpRoute(method string, path string, handler http.HandlerFunc) {
 	} else if method == "POST" {
 		http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 			// Check if domain is allowed
-			if !corsDomains[r.Header.Get("Origin")] && !corsAllowRoutes[path] {
+			if !corsDomains[r.Header.Get("Origin")] && !corsAllowRoutes[path] && !isApiKeyRequest(r) {
 				w.WriteHeader(http.StatusForbidden)
 				return
 			} else {
 				w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 				w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
 				if r.Method == "OPTIONS" {
 					w.WriteHeader(http.StatusOK)
 					return
@@ -63,6 +70,25 @@ func addHttpRoute(method string, path string, handler http.HandlerFunc) {
 	}
 }
 
+// getClientIp returns the IP address of the client. If TRUST_PROXY_HEADERS is true,
+// the address set by the reverse proxy in X-Real-IP or X-Forwarded-For is used
+func getClientIp(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return strings.TrimSpace(ip)
+		}
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func startHttpServer(listenAddr string) error {
 	// Parse CORS domains
 	corsDomains = make(map[string]bool)
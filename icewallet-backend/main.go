@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"os"
 )
@@ -12,14 +11,63 @@ func initHttpRoutes() {
 	addHttpRoute("POST", "/logout", logoutHandler)
 	addHttpRoute("POST", "/changePassword", changePasswordHandler)
 	addHttpRoute("GET", "/getPublicKey", getPublicKeyHandler)
+	addHttpRoute("GET", "/getLoginNonce", getLoginNonceHandler)
 	addHttpRoute("POST", "/clearTokens", clearTokensHandler)
 
+	// Two-factor authentication
+	addHttpRoute("POST", "/loginTwoFactor", loginTwoFactorHandler)
+	addHttpRoute("POST", "/enableTwoFactor", enableTwoFactorHandler)
+	addHttpRoute("POST", "/confirmTwoFactor", confirmTwoFactorHandler)
+	addHttpRoute("POST", "/disableTwoFactor", disableTwoFactorHandler)
+
+	// Passkeys
+	addHttpRoute("POST", "/beginPasskeyRegistration", beginPasskeyRegistrationHandler)
+	addHttpRoute("POST", "/finishPasskeyRegistration", finishPasskeyRegistrationHandler)
+	addHttpRoute("POST", "/beginPasskeyLogin", beginPasskeyLoginHandler)
+	addHttpRoute("POST", "/finishPasskeyLogin", finishPasskeyLoginHandler)
+	addHttpRoute("POST", "/getPasskeys", getPasskeysHandler)
+	addHttpRoute("POST", "/deletePasskey", deletePasskeyHandler)
+
+	// API keys
+	addHttpRoute("POST", "/createApiKey", createApiKeyHandler)
+	addHttpRoute("POST", "/getApiKeys", getApiKeysHandler)
+	addHttpRoute("POST", "/revokeApiKey", revokeApiKeyHandler)
+
+	// Audit log
+	addHttpRoute("POST", "/getAuditLog", getAuditLogHandler)
+
 	// Entry management
 	addHttpRoute("POST", "/createEntry", createEntryHandler)
 	addHttpRoute("POST", "/getEntries", getEntriesHandler)
 	addHttpRoute("POST", "/deleteEntry", deleteEntryHandler)
 	addHttpRoute("POST", "/updateEntry", updateEntryHandler)
 	addHttpRoute("POST", "/getMonthlyReport", getMonthlyReportHandler)
+	addHttpRoute("POST", "/getReport", getReportHandler)
+	addHttpRoute("POST", "/getBreakdownReport", getBreakdownReportHandler)
+	addHttpRoute("POST", "/getBalanceReport", getBalanceReportHandler)
+	addHttpRoute("POST", "/getComparisonReport", getComparisonReportHandler)
+	addHttpRoute("POST", "/getForecast", getForecastHandler)
+	addHttpRoute("POST", "/getTrash", getTrashHandler)
+	addHttpRoute("POST", "/restoreEntry", restoreEntryHandler)
+	addHttpRoute("GET", "/getEntryHistory", getEntryHistoryHandler)
+	addHttpRoute("POST", "/undoChanges", undoChangesHandler)
+	addHttpRoute("POST", "/bulkEntries", bulkEntriesHandler)
+
+	// Settings
+	addHttpRoute("POST", "/getSettings", getSettingsHandler)
+	addHttpRoute("POST", "/updateSettings", updateSettingsHandler)
+
+	// Saved filters
+	addHttpRoute("POST", "/createSavedFilter", createSavedFilterHandler)
+	addHttpRoute("POST", "/getSavedFilters", getSavedFiltersHandler)
+	addHttpRoute("POST", "/deleteSavedFilter", deleteSavedFilterHandler)
+
+	// Wallets
+	addHttpRoute("POST", "/getWallets", getWalletsHandler)
+	addHttpRoute("POST", "/createWallet", createWalletHandler)
+	addHttpRoute("POST", "/createInvitation", createInvitationHandler)
+	addHttpRoute("POST", "/acceptInvitation", acceptInvitationHandler)
+	addHttpRoute("POST", "/setWalletMember", setWalletMemberHandler)
 }
 
 func main() {
@@ -41,13 +89,13 @@ func main() {
 			log.Println("Be sure to update the .env file!")
 			log.Println("Key pair generated, exiting...")
 			return
-		} else if os.Args[1] == "--pwd" {
-			log.Println("You are in the password reset mode")
+		} else if cliModes[os.Args[1]] != "" {
+			log.Println("You are in the " + cliModes[os.Args[1]] + " mode")
 		} else {
-			log.Fatal("Use --genkey to generate a key pair\nUse --pwd to reset the password")
+			log.Fatal(cliUsage())
 		}
 	} else if len(os.Args) != 1 {
-		log.Fatal("Use --genkey to generate a key pair")
+		log.Fatal(cliUsage())
 	}
 
 	// Load environment variables
@@ -71,25 +119,33 @@ func main() {
 	}()
 	log.Println("Connected to database")
 
-	// Check password reset mode
-	if len(os.Args) == 2 && os.Args[1] == "--pwd" {
-		log.Print("Provide a new password: ")
-		var newPassword string
-		_, err := fmt.Scanln(&newPassword)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = changePassword(newPassword)
+	// Migrate data from before multi-user, wallet and entry version support
+	err = migrateSingleUser()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = migrateWallets()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = migrateEntryVersions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Check user management modes
+	if len(os.Args) == 2 {
+		err = runCliMode(os.Args[1])
 		if err != nil {
 			log.Fatal(err)
 		}
-		log.Println("Password changed successfully, exiting...")
+		log.Println("Done, exiting...")
 		return
 	}
 
-	// Check if password exists
-	if !checkPasswordExists() {
-		log.Fatal("Password does not exists, please run with --pwd to set a password")
+	// Check if any user exists
+	if !checkUsersExist() {
+		log.Fatal("No user exists, please run with --adduser to create a user")
 	}
 
 	// Decode private/public keys
@@ -102,6 +158,18 @@ func main() {
 	} else {
 		log.Println("WARNING: The private/public key pair seems to be invalid!")
 	}
+	if isLegacyPasswordTransportEnabled() {
+		log.Println("WARNING: Legacy RSA-PKCS1v15 password transport is enabled!")
+	}
+
+	// Load login rate limits and lockout settings
+	initLoginProtection()
+
+	// Load the timezone relative dates are resolved in
+	initDefaultTimezone()
+
+	// Purge trashed entries past the retention period
+	startTrashPurge()
 
 	// Start HTTP server
 	log.Println("Allowed domains:", os.Getenv("CORS_DOMAINS"))
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Fields entries can be sorted by, mapped to their database field. All entries have these fields,
+// which keyset pagination relies on
+var sortFields = map[string]string{
+	"date":        "date",
+	"amount":      "amount",
+	"description": "description",
+	"desc":        "description",
+	"createTime":  "createTime",
+	"entryDate":   "createTime",
+	"relevance":   relevanceField,
+}
+
+// The maximum number of sort keys in a sort
+const maxSortKeys = 3
+
+// sortKey is a field entries are sorted by
+type sortKey struct {
+	field      string
+	descending bool
+}
+
+// entrySort is the order of a list of entries. It always ends with _id, so that the order is
+// stable even when sort values are equal
+type entrySort []sortKey
+
+// String returns a description of the sort, used to check that a cursor belongs to the same sort
+func (s entrySort) String() string {
+	str := ""
+	for i, key := range s {
+		if i > 0 {
+			str += ","
+		}
+		str += key.field
+		if key.descending {
+			str += ":desc"
+		} else {
+			str += ":asc"
+		}
+	}
+	return str
+}
+
+// byRelevance checks whether the sort uses the relevance of a text search
+func (s entrySort) byRelevance() bool {
+	for _, key := range s {
+		if key.field == relevanceField {
+			return true
+		}
+	}
+	return false
+}
+
+// bsonSort returns the sort document for queries. With reverse, the order is reversed for paging backward
+func (s entrySort) bsonSort(reverse bool) bson.D {
+	sortDoc := bson.D{}
+	for _, key := range s {
+		if key.field == relevanceField {
+			// Most relevant first
+			sortDoc = append(sortDoc, bson.E{Key: key.field, Value: bson.M{"$meta": "textScore"}})
+			continue
+		}
+		order := 1
+		if key.descending != reverse {
+			order = -1
+		}
+		sortDoc = append(sortDoc, bson.E{Key: key.field, Value: order})
+	}
+	return sortDoc
+}
+
+// entryCursor marks a position in a list of entries. Cursors are opaque to clients
+type entryCursor struct {
+	Sort string `bson:"s"`
+	// The sort values of the entry at the position, ending with its _id
+	Values   primitive.A `bson:"v"`
+	Backward bool        `bson:"b"`
+}
+
+// parseSortKey reads a sort key of the form "field" or "field:asc" or "field:desc".
+// Without an order, the key is descending
+func parseSortKey(str string) (sortKey, error) {
+	parts := strings.SplitN(strings.TrimSpace(str), ":", 2)
+	field, known := sortFields[parts[0]]
+	if !known {
+		return sortKey{}, errors.New("unknown sort field: " + parts[0])
+	}
+
+	key := sortKey{field: field, descending: true}
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "asc":
+			key.descending = false
+		case "desc":
+		default:
+			return sortKey{}, errors.New("sort order must be asc or desc")
+		}
+	}
+	return key, nil
+}
+
+/**
+ * Read the sort of a request. The sort is either a string of comma separated keys, such as
+ * "date:desc,amount:asc", or an array of { field, order } objects. Defaults to date descending
+ * @return The sort, ending with _id, error if a field or order is unknown
+ */
+func parseEntrySort(value interface{}) (entrySort, error) {
+	var keys []string
+	switch v := value.(type) {
+	case nil:
+		keys = []string{"date"}
+	case string:
+		keys = strings.Split(v, ",")
+	case []interface{}:
+		for _, item := range v {
+			keyInfo, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("invalid sort")
+			}
+			field, _ := keyInfo["field"].(string)
+			order, _ := keyInfo["order"].(string)
+			if order != "" {
+				field += ":" + order
+			}
+			keys = append(keys, field)
+		}
+	default:
+		return nil, errors.New("invalid sort")
+	}
+	if len(keys) == 0 || len(keys) > maxSortKeys {
+		return nil, errors.New("invalid number of sort keys")
+	}
+
+	sort := entrySort{}
+	seen := make(map[string]bool)
+	for _, str := range keys {
+		key, err := parseSortKey(str)
+		if err != nil {
+			return nil, err
+		}
+		if seen[key.field] {
+			return nil, errors.New("duplicate sort field: " + key.field)
+		}
+		seen[key.field] = true
+		sort = append(sort, key)
+	}
+
+	// The direction of the tie breaker does not matter, following the last key lets an index serve the sort
+	return append(sort, sortKey{field: "_id", descending: sort[len(sort)-1].descending}), nil
+}
+
+// encodeCursor creates a cursor positioned at the entry, for paging forward past it or backward before it
+func encodeCursor(sort entrySort, entry bson.M, backward bool) (string, error) {
+	values := primitive.A{}
+	for _, key := range sort {
+		values = append(values, entry[key.field])
+	}
+
+	data, err := bson.Marshal(entryCursor{Sort: sort.String(), Values: values, Backward: backward})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor reads a cursor, checking that it was created for the same sort
+func decodeCursor(sort entrySort, cursorStr string) (entryCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursorStr)
+	if err != nil {
+		return entryCursor{}, errInvalidCursor
+	}
+
+	var cursor entryCursor
+	if err = bson.Unmarshal(data, &cursor); err != nil {
+		return entryCursor{}, errInvalidCursor
+	}
+	if sort.byRelevance() || cursor.Sort != sort.String() || len(cursor.Values) != len(sort) {
+		return entryCursor{}, errInvalidCursor
+	}
+	return cursor, nil
+}
+
+/**
+ * Build the query matching the entries after the cursor position, in the direction of the cursor.
+ * For sort keys k1, k2, ... the entries after (v1, v2, ...) are those with k1 after v1,
+ * or k1 equal to v1 and k2 after v2, and so on
+ */
+func buildKeysetQuery(sort entrySort, cursor entryCursor) bson.M {
+	or := make([]bson.M, 0, len(sort))
+	for i, key := range sort {
+		condition := bson.M{}
+		for j := 0; j < i; j++ {
+			condition[sort[j].field] = cursor.Values[j]
+		}
+		op := "$gt"
+		if key.descending != cursor.Backward {
+			op = "$lt"
+		}
+		condition[key.field] = bson.M{op: cursor.Values[i]}
+		or = append(or, condition)
+	}
+	return bson.M{"$or": or}
+}
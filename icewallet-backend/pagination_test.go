@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseEntrySort(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{name: "default", value: nil, want: "date:desc,_id:desc"},
+		{name: "single key", value: "amount", want: "amount:desc,_id:desc"},
+		{name: "ascending", value: "date:asc", want: "date:asc,_id:asc"},
+		{name: "several keys", value: "date:desc, amount:asc", want: "date:desc,amount:asc,_id:asc"},
+		{name: "aliases", value: "desc:asc,entryDate", want: "description:asc,createTime:desc,_id:desc"},
+		{name: "relevance", value: "relevance", want: "score:desc,_id:desc"},
+		{name: "array", value: []interface{}{
+			map[string]interface{}{"field": "date", "order": "asc"},
+			map[string]interface{}{"field": "amount"},
+		}, want: "date:asc,amount:desc,_id:desc"},
+		{name: "unknown field", value: "category", wantErr: true},
+		{name: "unknown order", value: "date:up", wantErr: true},
+		{name: "duplicate field", value: "desc,description", wantErr: true},
+		{name: "too many keys", value: "date,amount,description,createTime", wantErr: true},
+		{name: "empty array", value: []interface{}{}, wantErr: true},
+		{name: "array of strings", value: []interface{}{"date"}, wantErr: true},
+		{name: "number", value: 1.0, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sort, err := parseEntrySort(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseEntrySort() = %s, want error", sort)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEntrySort() error = %v", err)
+			}
+			if sort.String() != test.want {
+				t.Errorf("parseEntrySort() = %s, want %s", sort, test.want)
+			}
+		})
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	id := primitive.NewObjectID()
+	date := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC)
+	entry := bson.M{"_id": id, "date": primitive.NewDateTimeFromTime(date), "amount": -12.5, "description": "Coffee"}
+
+	tests := []struct {
+		name     string
+		sort     string
+		backward bool
+		want     primitive.A
+	}{
+		{name: "date forward", sort: "date", want: primitive.A{primitive.NewDateTimeFromTime(date), id}},
+		{name: "date backward", sort: "date", backward: true, want: primitive.A{primitive.NewDateTimeFromTime(date), id}},
+		{name: "several keys", sort: "description:asc,amount", want: primitive.A{"Coffee", -12.5, id}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sort, err := parseEntrySort(test.sort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cursorStr, err := encodeCursor(sort, entry, test.backward)
+			if err != nil {
+				t.Fatalf("encodeCursor() error = %v", err)
+			}
+			cursor, err := decodeCursor(sort, cursorStr)
+			if err != nil {
+				t.Fatalf("decodeCursor() error = %v", err)
+			}
+			if cursor.Backward != test.backward || cursor.Sort != sort.String() {
+				t.Errorf("decodeCursor() = %+v", cursor)
+			}
+			if !reflect.DeepEqual(cursor.Values, test.want) {
+				t.Errorf("decodeCursor() values = %#v, want %#v", cursor.Values, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejected(t *testing.T) {
+	entry := bson.M{"_id": primitive.NewObjectID(), "date": primitive.NewDateTimeFromTime(time.Now()), "amount": 3.0}
+	dateSort, _ := parseEntrySort("date")
+	amountSort, _ := parseEntrySort("amount")
+	relevanceSort, _ := parseEntrySort("relevance")
+	dateCursor, _ := encodeCursor(dateSort, entry, false)
+	relevanceCursor, _ := encodeCursor(relevanceSort, entry, false)
+	shortValues, _ := bson.Marshal(entryCursor{Sort: dateSort.String(), Values: primitive.A{entry["date"]}})
+
+	tests := []struct {
+		name   string
+		sort   entrySort
+		cursor string
+	}{
+		{name: "other sort", sort: amountSort, cursor: dateCursor},
+		{name: "relevance sort", sort: relevanceSort, cursor: relevanceCursor},
+		{name: "missing values", sort: dateSort, cursor: base64.RawURLEncoding.EncodeToString(shortValues)},
+		{name: "not base64", sort: dateSort, cursor: "not a cursor!"},
+		{name: "not bson", sort: dateSort, cursor: base64.RawURLEncoding.EncodeToString([]byte("cursor"))},
+		{name: "truncated", sort: dateSort, cursor: dateCursor[:len(dateCursor)/2]},
+		{name: "empty", sort: dateSort, cursor: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodeCursor(test.sort, test.cursor); err != errInvalidCursor {
+				t.Errorf("decodeCursor() error = %v, want %v", err, errInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestBuildKeysetQuery(t *testing.T) {
+	id := primitive.NewObjectID()
+	sort, _ := parseEntrySort("date:desc,amount:asc")
+
+	tests := []struct {
+		name     string
+		backward bool
+		want     bson.M
+	}{
+		{name: "forward", want: bson.M{"$or": []bson.M{
+			{"date": bson.M{"$lt": "d"}},
+			{"date": "d", "amount": bson.M{"$gt": 5.0}},
+			{"date": "d", "amount": 5.0, "_id": bson.M{"$gt": id}},
+		}}},
+		{name: "backward", backward: true, want: bson.M{"$or": []bson.M{
+			{"date": bson.M{"$gt": "d"}},
+			{"date": "d", "amount": bson.M{"$lt": 5.0}},
+			{"date": "d", "amount": 5.0, "_id": bson.M{"$lt": id}},
+		}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cursor := entryCursor{Sort: sort.String(), Values: primitive.A{"d", 5.0, id}, Backward: test.backward}
+			if got := buildKeysetQuery(sort, cursor); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("buildKeysetQuery() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
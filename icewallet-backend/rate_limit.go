@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// rateLimiter allows at most limit hits per key within each fixed time window
+type rateLimiter struct {
+	mutex   sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string]*rateWindow
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+// allow records a hit for the key. If the limit has been reached, returns false and
+// the time until the current window ends
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	current, exists := l.windows[key]
+	if !exists || now.Sub(current.start) >= l.window {
+		// Drop finished windows so the map does not grow unbounded
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+		current = &rateWindow{start: now}
+		l.windows[key] = current
+	}
+
+	if current.count >= l.limit {
+		return false, current.start.Add(l.window).Sub(now)
+	}
+	current.count++
+	return true, 0
+}
+
+// Login protection settings, loaded from the environment by initLoginProtection
+var loginIpLimiter *rateLimiter
+var loginGlobalLimiter *rateLimiter
+var loginMaxFailures int
+var loginLockoutDuration time.Duration
+
+// loginFailures is the meta document tracking failed login attempts of a login subject
+type loginFailures struct {
+	Type        string             `bson:"type"`
+	Ip          string             `bson:"ip,omitempty"`
+	UserId      primitive.ObjectID `bson:"user,omitempty"`
+	Failures    int                `bson:"failures"`
+	LastFailure time.Time          `bson:"lastFailure"`
+	LockedUntil time.Time          `bson:"lockedUntil"`
+}
+
+// loginSubject is whose failed login attempts are counted: a client IP, or a user whose
+// password was verified but whose second factor was wrong
+type loginSubject struct {
+	field string
+	value interface{}
+}
+
+func ipSubject(ip string) loginSubject {
+	return loginSubject{field: "ip", value: ip}
+}
+
+func userSubject(userId primitive.ObjectID) loginSubject {
+	return loginSubject{field: "user", value: userId}
+}
+
+func (s loginSubject) filter() bson.M {
+	return bson.M{"type": "loginFailures", s.field: s.value}
+}
+
+func (s loginSubject) String() string {
+	if userId, ok := s.value.(primitive.ObjectID); ok {
+		return "user " + userId.Hex()
+	}
+	return fmt.Sprint(s.value)
+}
+
+func initLoginProtection() {
+	loginIpLimiter = newRateLimiter(getEnvInt("LOGIN_RATE_PER_IP", 10), time.Minute)
+	loginGlobalLimiter = newRateLimiter(getEnvInt("LOGIN_RATE_GLOBAL", 60), time.Minute)
+	loginMaxFailures = getEnvInt("LOGIN_MAX_FAILURES", 5)
+	loginLockoutDuration = time.Duration(getEnvInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+}
+
+func findLoginFailures(subject loginSubject) (loginFailures, error) {
+	var result loginFailures
+	err := getMetaColl().FindOne(context.TODO(), subject.filter()).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return loginFailures{}, nil
+	}
+	return result, err
+}
+
+// loginBackoff returns the delay required after the given number of consecutive failures.
+// The delay doubles with each failure, starting at 1 second and capped at the lockout duration
+func loginBackoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := time.Second
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if delay >= loginLockoutDuration {
+			return loginLockoutDuration
+		}
+	}
+	return delay
+}
+
+/**
+ * Check whether a login attempt from the client IP may proceed
+ * @param ip The client IP
+ * @return Whether the attempt is allowed, and if not, how long the client should wait
+ */
+func checkLoginAllowed(ip string) (bool, time.Duration) {
+	// Per-IP rate limit and lockout first, so that a client which is over its limit
+	// or locked out does not use up the global budget shared by everyone
+	if ok, retryAfter := loginIpLimiter.allow(ip); !ok {
+		return false, retryAfter
+	}
+	if ok, retryAfter := checkLoginLockout(ipSubject(ip)); !ok {
+		return false, retryAfter
+	}
+	return loginGlobalLimiter.allow("")
+}
+
+/**
+ * Check whether a login subject is locked out or must wait after failed attempts
+ * @param subject The client IP or user
+ * @return Whether the attempt is allowed, and if not, how long the client should wait
+ */
+func checkLoginLockout(subject loginSubject) (bool, time.Duration) {
+	// Lockout and exponential backoff after failed attempts
+	failures, err := findLoginFailures(subject)
+	if err != nil {
+		log.Println("Failed to read login failures:", err)
+		return false, time.Minute
+	}
+	now := time.Now()
+	if now.Before(failures.LockedUntil) {
+		return false, failures.LockedUntil.Sub(now)
+	}
+	nextAttempt := failures.LastFailure.Add(loginBackoff(failures.Failures))
+	if now.Before(nextAttempt) {
+		return false, nextAttempt.Sub(now)
+	}
+
+	return true, 0
+}
+
+// recordLoginFailure counts a failed login attempt of the subject and locks it out
+// once LOGIN_MAX_FAILURES consecutive failures are reached
+func recordLoginFailure(subject loginSubject) error {
+	failures, err := findLoginFailures(subject)
+	if err != nil {
+		return err
+	}
+
+	// Failures older than the lockout duration are forgotten
+	now := time.Now()
+	if now.Sub(failures.LastFailure) > loginLockoutDuration {
+		failures.Failures = 0
+	}
+	failures.Failures++
+
+	var lockedUntil time.Time
+	if failures.Failures >= loginMaxFailures {
+		lockedUntil = now.Add(loginLockoutDuration)
+		log.Printf("Login locked for %s after %d failed attempts", subject, failures.Failures)
+	} else {
+		log.Printf("Failed login attempt from %s (%d/%d)", subject, failures.Failures, loginMaxFailures)
+	}
+
+	_, err = getMetaColl().UpdateOne(context.TODO(), subject.filter(), bson.M{
+		"$set": bson.M{
+			"failures":    failures.Failures,
+			"lastFailure": now,
+			"lockedUntil": lockedUntil,
+		},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// clearLoginFailures resets the failure count of the subject after a successful login
+func clearLoginFailures(subject loginSubject) error {
+	_, err := getMetaColl().DeleteOne(context.TODO(), subject.filter())
+	return err
+}
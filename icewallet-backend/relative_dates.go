@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	// Embed the timezone database, so that timezones work on systems without one
+	_ "time/tzdata"
+)
+
+var errInvalidRelativeDate = errors.New("invalid relative date")
+
+// The timezone used when neither the request nor the user gives one, set by TIMEZONE
+var defaultLocation = time.UTC
+
+// Offsets from now, such as "now-90d" or "now+2w"
+var relativeOffsetRegex = regexp.MustCompile(`^now(?:([+-])(\d{1,4})([hdwmy]))?$`)
+
+// dateRange is the value of a relative date. Periods such as "last-month" cover [Start, End),
+// while points in time such as "now-30d" have no End
+type dateRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// isPeriod checks whether the range covers a period rather than a point in time
+func (r dateRange) isPeriod() bool {
+	return !r.End.IsZero()
+}
+
+// initDefaultTimezone reads the TIMEZONE environment variable, an IANA timezone such as "America/Toronto"
+func initDefaultTimezone() {
+	name := os.Getenv("TIMEZONE")
+	if name == "" {
+		return
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("WARNING: TIMEZONE %s is not a valid timezone, using UTC", name)
+		return
+	}
+	defaultLocation = location
+}
+
+// parseTimezone reads an optional IANA timezone, falling back to the default timezone
+func parseTimezone(value interface{}) (*time.Location, error) {
+	if value == nil {
+		return defaultLocation, nil
+	}
+	name, ok := value.(string)
+	if !ok || name == "" {
+		return nil, errors.New("invalid timezone")
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.New("invalid timezone")
+	}
+	return location, nil
+}
+
+// startOf returns the start of the day, week, month, quarter or year containing t, in the location of t.
+// Weeks start on Monday
+func startOf(t time.Time, unit string) (time.Time, error) {
+	year, month, day := t.Date()
+	switch unit {
+	case "day":
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location()), nil
+	case "week":
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-daysSinceMonday, 0, 0, 0, 0, t.Location()), nil
+	case "month":
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location()), nil
+	case "quarter":
+		return time.Date(year, month-(month-1)%3, 1, 0, 0, 0, 0, t.Location()), nil
+	case "year":
+		return time.Date(year, 1, 1, 0, 0, 0, 0, t.Location()), nil
+	}
+	return time.Time{}, errInvalidRelativeDate
+}
+
+// addPeriods moves a period start by count days, weeks, months, quarters or years
+func addPeriods(t time.Time, unit string, count int) time.Time {
+	switch unit {
+	case "day":
+		return t.AddDate(0, 0, count)
+	case "week":
+		return t.AddDate(0, 0, 7*count)
+	case "month":
+		return t.AddDate(0, count, 0)
+	case "quarter":
+		return t.AddDate(0, 3*count, 0)
+	default:
+		return t.AddDate(count, 0, 0)
+	}
+}
+
+// periodRange returns the period of the unit containing now, moved by offset periods
+func periodRange(now time.Time, unit string, offset int) (dateRange, error) {
+	start, err := startOf(now, unit)
+	if err != nil {
+		return dateRange{}, err
+	}
+	start = addPeriods(start, unit, offset)
+	return dateRange{Start: start, End: addPeriods(start, unit, 1)}, nil
+}
+
+/**
+ * Resolve a date relative to now. Supported expressions are:
+ * - points in time: "now", offsets such as "now-30d" (units h, d, w, m for months and y),
+ *   and "start-of-day", "start-of-week", "start-of-month", "start-of-quarter", "start-of-year"
+ * - periods: "today", "yesterday", "this-week", "last-week", "this-month", "last-month",
+ *   "this-quarter", "last-quarter", "this-year", "last-year", and "ytd" from the start of the year until now
+ * Days, weeks and months start at midnight in the location of now
+ * @param expr The expression
+ * @param now The current time, in the timezone to resolve the expression in
+ * @return The resolved date or period, error if the expression is invalid
+ */
+func parseRelativeDate(expr string, now time.Time) (dateRange, error) {
+	switch expr {
+	case "today":
+		return periodRange(now, "day", 0)
+	case "yesterday":
+		return periodRange(now, "day", -1)
+	case "ytd":
+		start, _ := startOf(now, "year")
+		return dateRange{Start: start, End: now}, nil
+	}
+	if strings.HasPrefix(expr, "this-") {
+		return periodRange(now, strings.TrimPrefix(expr, "this-"), 0)
+	}
+	if strings.HasPrefix(expr, "last-") {
+		return periodRange(now, strings.TrimPrefix(expr, "last-"), -1)
+	}
+	if strings.HasPrefix(expr, "start-of-") {
+		start, err := startOf(now, strings.TrimPrefix(expr, "start-of-"))
+		return dateRange{Start: start}, err
+	}
+
+	match := relativeOffsetRegex.FindStringSubmatch(expr)
+	if match == nil {
+		return dateRange{}, errInvalidRelativeDate
+	}
+	if match[1] == "" {
+		return dateRange{Start: now}, nil
+	}
+	amount, _ := strconv.Atoi(match[2])
+	if match[1] == "-" {
+		amount = -amount
+	}
+	switch match[3] {
+	case "h":
+		return dateRange{Start: now.Add(time.Duration(amount) * time.Hour)}, nil
+	case "d":
+		return dateRange{Start: now.AddDate(0, 0, amount)}, nil
+	case "w":
+		return dateRange{Start: now.AddDate(0, 0, amount*7)}, nil
+	case "m":
+		return dateRange{Start: now.AddDate(0, amount, 0)}, nil
+	default:
+		return dateRange{Start: now.AddDate(amount, 0, 0)}, nil
+	}
+}
+
+// parseDateValue reads a date that is either in RFC3339 format or relative to now, see parseRelativeDate
+func parseDateValue(value string, now time.Time) (dateRange, error) {
+	parsedTime, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return dateRange{Start: parsedTime}, nil
+	}
+	return parseRelativeDate(value, now)
+}
+
+/**
+ * Build the condition of a date filter on a relative period. A period behaves like a single value:
+ * Eq matches dates within it, Neq dates outside of it, Lt dates before it, Leq dates before its end,
+ * Gt dates after it and Geq dates from its start
+ * @param op The filter op
+ * @param period The period, see parseRelativeDate
+ * @return The condition, error if the op does not apply to dates
+ */
+func buildPeriodCondition(op int, period dateRange) (interface{}, error) {
+	within := bson.M{"$gte": period.Start, "$lt": period.End}
+	switch op {
+	case Lt:
+		return bson.M{"$lt": period.Start}, nil
+	case Leq:
+		return bson.M{"$lt": period.End}, nil
+	case Gt:
+		return bson.M{"$gte": period.End}, nil
+	case Geq:
+		return bson.M{"$gte": period.Start}, nil
+	case Eq:
+		return within, nil
+	case Neq:
+		return bson.M{"$not": within}, nil
+	}
+	return nil, errors.New("invalid filter op")
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestParseRelativeDate(t *testing.T) {
+	toronto := mustLoadLocation(t, "America/Toronto")
+	// A Wednesday
+	now := time.Date(2024, 5, 15, 15, 4, 5, 0, toronto)
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, toronto)
+	}
+
+	tests := []struct {
+		expr    string
+		want    dateRange
+		wantErr bool
+	}{
+		{expr: "today", want: dateRange{Start: date(2024, 5, 15), End: date(2024, 5, 16)}},
+		{expr: "yesterday", want: dateRange{Start: date(2024, 5, 14), End: date(2024, 5, 15)}},
+		{expr: "this-week", want: dateRange{Start: date(2024, 5, 13), End: date(2024, 5, 20)}},
+		{expr: "last-week", want: dateRange{Start: date(2024, 5, 6), End: date(2024, 5, 13)}},
+		{expr: "this-month", want: dateRange{Start: date(2024, 5, 1), End: date(2024, 6, 1)}},
+		{expr: "last-month", want: dateRange{Start: date(2024, 4, 1), End: date(2024, 5, 1)}},
+		{expr: "this-quarter", want: dateRange{Start: date(2024, 4, 1), End: date(2024, 7, 1)}},
+		{expr: "last-quarter", want: dateRange{Start: date(2024, 1, 1), End: date(2024, 4, 1)}},
+		{expr: "this-year", want: dateRange{Start: date(2024, 1, 1), End: date(2025, 1, 1)}},
+		{expr: "last-year", want: dateRange{Start: date(2023, 1, 1), End: date(2024, 1, 1)}},
+		{expr: "ytd", want: dateRange{Start: date(2024, 1, 1), End: now}},
+		{expr: "start-of-day", want: dateRange{Start: date(2024, 5, 15)}},
+		{expr: "start-of-week", want: dateRange{Start: date(2024, 5, 13)}},
+		{expr: "start-of-month", want: dateRange{Start: date(2024, 5, 1)}},
+		{expr: "start-of-quarter", want: dateRange{Start: date(2024, 4, 1)}},
+		{expr: "start-of-year", want: dateRange{Start: date(2024, 1, 1)}},
+		{expr: "now", want: dateRange{Start: now}},
+		{expr: "now-12h", want: dateRange{Start: now.Add(-12 * time.Hour)}},
+		{expr: "now-30d", want: dateRange{Start: time.Date(2024, 4, 15, 15, 4, 5, 0, toronto)}},
+		{expr: "now+2w", want: dateRange{Start: time.Date(2024, 5, 29, 15, 4, 5, 0, toronto)}},
+		{expr: "now-3m", want: dateRange{Start: time.Date(2024, 2, 15, 15, 4, 5, 0, toronto)}},
+		{expr: "now-1y", want: dateRange{Start: time.Date(2023, 5, 15, 15, 4, 5, 0, toronto)}},
+		{expr: "this-decade", wantErr: true},
+		{expr: "last-", wantErr: true},
+		{expr: "start-of-hour", wantErr: true},
+		{expr: "now-", wantErr: true},
+		{expr: "now-5x", wantErr: true},
+		{expr: "now-12345d", wantErr: true},
+		{expr: "now - 5d", wantErr: true},
+		{expr: "Today", wantErr: true},
+		{expr: "", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			got, err := parseRelativeDate(test.expr, now)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseRelativeDate() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRelativeDate() error = %v", err)
+			}
+			if !got.Start.Equal(test.want.Start) || !got.End.Equal(test.want.End) {
+				t.Errorf("parseRelativeDate() = %v - %v, want %v - %v", got.Start, got.End, test.want.Start, test.want.End)
+			}
+			if got.isPeriod() != test.want.isPeriod() {
+				t.Errorf("isPeriod() = %v, want %v", got.isPeriod(), test.want.isPeriod())
+			}
+		})
+	}
+}
+
+func TestParseRelativeDateAcrossDst(t *testing.T) {
+	toronto := mustLoadLocation(t, "America/Toronto")
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		expr      string
+		wantStart string
+		wantEnd   string
+		wantHours float64
+	}{
+		// Clocks go forward at 2:00 on March 10, 2024, and back at 2:00 on November 3, 2024
+		{name: "short day", now: time.Date(2024, 3, 10, 12, 0, 0, 0, toronto), expr: "today",
+			wantStart: "2024-03-10T00:00:00-05:00", wantEnd: "2024-03-11T00:00:00-04:00", wantHours: 23},
+		{name: "long day", now: time.Date(2024, 11, 3, 12, 0, 0, 0, toronto), expr: "today",
+			wantStart: "2024-11-03T00:00:00-04:00", wantEnd: "2024-11-04T00:00:00-05:00", wantHours: 25},
+		{name: "week with a short day", now: time.Date(2024, 3, 12, 9, 0, 0, 0, toronto), expr: "last-week",
+			wantStart: "2024-03-04T00:00:00-05:00", wantEnd: "2024-03-11T00:00:00-04:00", wantHours: 7*24 - 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseRelativeDate(test.expr, test.now)
+			if err != nil {
+				t.Fatalf("parseRelativeDate() error = %v", err)
+			}
+			if got.Start.Format(time.RFC3339) != test.wantStart || got.End.Format(time.RFC3339) != test.wantEnd {
+				t.Errorf("parseRelativeDate() = %s - %s, want %s - %s",
+					got.Start.Format(time.RFC3339), got.End.Format(time.RFC3339), test.wantStart, test.wantEnd)
+			}
+			if hours := got.End.Sub(got.Start).Hours(); hours != test.wantHours {
+				t.Errorf("period lasts %v hours, want %v", hours, test.wantHours)
+			}
+		})
+	}
+}
+
+func TestStartOfWeekOnSunday(t *testing.T) {
+	// Weeks start on Monday, so a Sunday belongs to the week starting 6 days before
+	sunday := time.Date(2024, 5, 19, 23, 0, 0, 0, time.UTC)
+	got, err := startOf(sunday, "week")
+	if err != nil || !got.Equal(time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("startOf() = %v, %v, want 2024-05-13", got, err)
+	}
+}
+
+func TestParseTimezone(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{name: "default", value: nil, want: defaultLocation.String()},
+		{name: "iana name", value: "Europe/Paris", want: "Europe/Paris"},
+		{name: "utc", value: "UTC", want: "UTC"},
+		{name: "empty", value: "", wantErr: true},
+		{name: "unknown", value: "Mars/Olympus_Mons", wantErr: true},
+		{name: "offset", value: "+02:00", wantErr: true},
+		{name: "number", value: 2.0, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseTimezone(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseTimezone() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTimezone() error = %v", err)
+			}
+			if got.String() != test.want {
+				t.Errorf("parseTimezone() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDateValue(t *testing.T) {
+	now := time.Date(2024, 5, 15, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		value   string
+		want    dateRange
+		wantErr bool
+	}{
+		{value: "2024-02-01T10:00:00Z", want: dateRange{Start: time.Date(2024, 2, 1, 10, 0, 0, 0, time.UTC)}},
+		{value: "2024-02-01T10:00:00+02:00", want: dateRange{Start: time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC)}},
+		{value: "last-month", want: dateRange{
+			Start: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			End:   time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		}},
+		{value: "now-7d", want: dateRange{Start: time.Date(2024, 5, 8, 15, 4, 5, 0, time.UTC)}},
+		{value: "2024-02-01", wantErr: true},
+		{value: "yesterday-ish", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseDateValue(test.value, now)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseDateValue() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDateValue() error = %v", err)
+			}
+			if !got.Start.Equal(test.want.Start) || !got.End.Equal(test.want.End) {
+				t.Errorf("parseDateValue() = %v - %v, want %v - %v", got.Start, got.End, test.want.Start, test.want.End)
+			}
+		})
+	}
+}
+
+func TestBuildPeriodCondition(t *testing.T) {
+	period := dateRange{
+		Start: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	within := bson.M{"$gte": period.Start, "$lt": period.End}
+
+	tests := []struct {
+		name    string
+		op      int
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "Eq", op: Eq, want: within},
+		{name: "Neq", op: Neq, want: bson.M{"$not": within}},
+		{name: "Lt", op: Lt, want: bson.M{"$lt": period.Start}},
+		{name: "Leq", op: Leq, want: bson.M{"$lt": period.End}},
+		{name: "Gt", op: Gt, want: bson.M{"$gte": period.End}},
+		{name: "Geq", op: Geq, want: bson.M{"$gte": period.Start}},
+		{name: "Contains", op: Contains, wantErr: true},
+		{name: "In", op: In, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := buildPeriodCondition(test.op, period)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("buildPeriodCondition() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildPeriodCondition() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("buildPeriodCondition() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Report periods
+const (
+	PeriodDay     = "day"
+	PeriodWeek    = "week"
+	PeriodMonth   = "month"
+	PeriodQuarter = "quarter"
+	PeriodYear    = "year"
+)
+
+// The $dateToString format of the group key of each period. Weeks are ISO weeks. Quarters are grouped
+// by month and combined afterwards, since $dateToString has no quarter format
+var periodKeyFormats = map[string]string{
+	PeriodDay:     "%Y-%m-%d",
+	PeriodWeek:    "%G-W%V",
+	PeriodMonth:   "%Y-%m",
+	PeriodQuarter: "%Y-%m",
+	PeriodYear:    "%Y",
+}
+
+// The maximum number of periods of a report, which is over 2 years of days
+const maxReportBuckets = 1000
+
+var errTooManyBuckets = errors.New("too many periods, at most 1000 can be reported at once")
+
+// reportBucket is the income and expense of one period of a report
+type reportBucket struct {
+	Start   time.Time `json:"start"`
+	Label   string    `json:"label"`
+	Income  float64   `json:"income"`
+	Expense float64   `json:"expense"`
+	Net     float64   `json:"net"`
+	Count   int64     `json:"count"`
+}
+
+// reportGroup is a result of the $group stage of a report
+type reportGroup struct {
+	Key     string  `bson:"_id"`
+	Income  float64 `bson:"income"`
+	Expense float64 `bson:"expense"`
+	Count   int64   `bson:"count"`
+}
+
+// formatPeriodKey formats a time like the $dateToString group key of the period
+func formatPeriodKey(t time.Time, period string) string {
+	switch period {
+	case PeriodDay:
+		return t.Format("2006-01-02")
+	case PeriodWeek:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	case PeriodYear:
+		return t.Format("2006")
+	default:
+		return t.Format("2006-01")
+	}
+}
+
+// periodLabel returns the label of the period starting at start, such as "2025-03-14", "2025-W11",
+// "2025-03", "2025-Q1" or "2025"
+func periodLabel(start time.Time, period string) string {
+	if period == PeriodQuarter {
+		return fmt.Sprintf("%d-Q%d", start.Year(), (int(start.Month())-1)/3+1)
+	}
+	return formatPeriodKey(start, period)
+}
+
+// incomeSum is the $group accumulator of income, the sum of positive amounts
+func incomeSum() bson.M {
+	return bson.M{
+		"$sum": bson.M{
+			"$cond": bson.M{
+				"if":   bson.M{"$gte": []interface{}{"$amount", 0}},
+				"then": "$amount",
+				"else": 0,
+			},
+		},
+	}
+}
+
+// expenseSum is the $group accumulator of expense, the sum of the absolute values of negative amounts
+func expenseSum() bson.M {
+	return bson.M{
+		"$sum": bson.M{
+			"$cond": bson.M{
+				"if":   bson.M{"$lt": []interface{}{"$amount", 0}},
+				"then": bson.M{"$abs": "$amount"},
+				"else": 0,
+			},
+		},
+	}
+}
+
+// matchDateRange adds the date range [from, to) to a query built by buildFilters, which keeps its
+// conditions in $and so that the date range can be added beside them
+func matchDateRange(query map[string]interface{}, from time.Time, to time.Time) bson.M {
+	match := bson.M{
+		"date": bson.M{
+			"$gte": from,
+			"$lt":  to,
+		},
+	}
+	for key, value := range query {
+		match[key] = value
+	}
+	return match
+}
+
+/**
+ * Build the empty buckets of the periods overlapping a date range
+ * @param from The start of the range, in the timezone periods start in
+ * @param to The end of the range, excluded
+ * @param period The length of the buckets
+ * @return The buckets, errTooManyBuckets if the range is too long
+ */
+func buildReportBuckets(from time.Time, to time.Time, period string) ([]reportBucket, error) {
+	start, err := startOf(from, period)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := []reportBucket{}
+	for ; start.Before(to); start = addPeriods(start, period, 1) {
+		if len(buckets) == maxReportBuckets {
+			return nil, errTooManyBuckets
+		}
+		buckets = append(buckets, reportBucket{Start: start, Label: periodLabel(start, period)})
+	}
+	return buckets, nil
+}
+
+/**
+ * Aggregate the income and expense of the entries matching the query by period.
+ * Periods without entries are included with zero values
+ * @param query The query built by buildFilters
+ * @param from The start of the date range
+ * @param to The end of the date range, excluded
+ * @param period The length of the periods, day, week, month, quarter or year
+ * @param location The timezone periods start in
+ * @return The periods in chronological order, error
+ */
+func getPeriodReport(query map[string]interface{}, from time.Time, to time.Time, period string, location *time.Location) ([]reportBucket, error) {
+	format, ok := periodKeyFormats[period]
+	if !ok {
+		return nil, errors.New("invalid period")
+	}
+	buckets, err := buildReportBuckets(from.In(location), to, period)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := []bson.M{
+		{"$match": matchDateRange(query, from, to)},
+		{
+			"$group": bson.M{
+				"_id": bson.M{
+					"$dateToString": bson.M{"format": format, "date": "$date", "timezone": location.String()},
+				},
+				"income":  incomeSum(),
+				"expense": expenseSum(),
+				"count":   bson.M{"$sum": 1},
+			},
+		},
+	}
+
+	cursor, err := getEntriesColl().Aggregate(context.TODO(), pipeline, options.Aggregate().SetMaxTime(entryQueryTimeout))
+	if err != nil {
+		return nil, err
+	}
+	var groups []reportGroup
+	if err = cursor.All(context.Background(), &groups); err != nil {
+		return nil, err
+	}
+
+	// Find the bucket of each group key. A quarter has the keys of its three months
+	bucketIndexes := make(map[string]int)
+	for i, bucket := range buckets {
+		if period == PeriodQuarter {
+			for month := 0; month < 3; month++ {
+				bucketIndexes[formatPeriodKey(bucket.Start.AddDate(0, month, 0), PeriodMonth)] = i
+			}
+		} else {
+			bucketIndexes[formatPeriodKey(bucket.Start, period)] = i
+		}
+	}
+
+	for _, group := range groups {
+		i, exists := bucketIndexes[group.Key]
+		if !exists {
+			continue
+		}
+		buckets[i].Income += group.Income
+		buckets[i].Expense += group.Expense
+		buckets[i].Count += group.Count
+	}
+	for i := range buckets {
+		buckets[i].Net = buckets[i].Income - buckets[i].Expense
+	}
+	return buckets, nil
+}
+
+// Breakdown report dimensions, mapped to their database field
+var breakdownDimensions = map[string]string{
+	"description": "description",
+	"category":    "category",
+}
+
+// Money flows a breakdown report sums
+const (
+	FlowExpense = "expense"
+	FlowIncome  = "income"
+)
+
+// The default and maximum number of items of a breakdown report, besides "Other"
+const (
+	defaultBreakdownLimit = 10
+	maxBreakdownLimit     = 50
+)
+
+// breakdownGroup is a result of the $group stage of a breakdown report
+type breakdownGroup struct {
+	Key   string  `bson:"_id"`
+	Total float64 `bson:"total"`
+	Count int64   `bson:"count"`
+}
+
+// breakdownItem is the total of one value of the dimension of a breakdown report
+type breakdownItem struct {
+	Key           string  `json:"key"`
+	Total         float64 `json:"total"`
+	Count         int64   `json:"count"`
+	Share         float64 `json:"share"`
+	PreviousTotal float64 `json:"previousTotal"`
+	Change        float64 `json:"change"`
+	// Nil if there was nothing in the previous period
+	ChangePercent *float64 `json:"changePercent"`
+}
+
+// breakdownReport is the result of getBreakdownReport
+type breakdownReport struct {
+	Items []breakdownItem
+	// The sum of the items after the top ones, nil if there are none
+	Other         *breakdownItem
+	Total         float64
+	Count         int64
+	PreviousTotal float64
+	PreviousFrom  time.Time
+	PreviousTo    time.Time
+}
+
+/**
+ * Find the period just before a date range, used to compare a report with the previous equivalent period.
+ * Ranges of whole months, such as a month, quarter or year, move by months, and ranges of whole days by days
+ * @param from The start of the range, in the timezone of the report
+ * @param to The end of the range, excluded
+ * @return The start and end of the previous period
+ */
+func previousPeriod(from time.Time, to time.Time) (time.Time, time.Time) {
+	months := (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month())
+	if months > 0 && from.Day() == 1 && from.AddDate(0, months, 0).Equal(to) {
+		return from.AddDate(0, -months, 0), from
+	}
+	days := int(math.Round(to.Sub(from).Hours() / 24))
+	if days > 0 && from.AddDate(0, 0, days).Equal(to) {
+		return from.AddDate(0, 0, -days), from
+	}
+	return from.Add(-to.Sub(from)), from
+}
+
+// changePercent returns the relative change from previous to current in percent, or nil if previous is zero
+func changePercent(previous float64, current float64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	percent := (current - previous) / math.Abs(previous) * 100
+	return &percent
+}
+
+// sumByDimension sums the income or expense of the entries matching the query in a date range by a field,
+// largest first. Entries without the field are grouped under an empty key
+func sumByDimension(query map[string]interface{}, from time.Time, to time.Time, field string, flow string) ([]breakdownGroup, error) {
+	match := matchDateRange(query, from, to)
+	if flow == FlowIncome {
+		match["amount"] = bson.M{"$gt": 0}
+	} else {
+		match["amount"] = bson.M{"$lt": 0}
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{
+			"$group": bson.M{
+				"_id":   bson.M{"$ifNull": []interface{}{"$" + field, ""}},
+				"total": bson.M{"$sum": bson.M{"$abs": "$amount"}},
+				"count": bson.M{"$sum": 1},
+			},
+		},
+		{"$sort": bson.D{{Key: "total", Value: -1}, {Key: "_id", Value: 1}}},
+	}
+
+	cursor, err := getEntriesColl().Aggregate(context.TODO(), pipeline, options.Aggregate().SetMaxTime(entryQueryTimeout))
+	if err != nil {
+		return nil, err
+	}
+	var groups []breakdownGroup
+	if err = cursor.All(context.Background(), &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// compareBreakdownItem computes the share of an item in the total and its change from the previous period
+func compareBreakdownItem(item *breakdownItem, total float64) {
+	if total != 0 {
+		item.Share = item.Total / total
+	}
+	item.Change = item.Total - item.PreviousTotal
+	item.ChangePercent = changePercent(item.PreviousTotal, item.Total)
+}
+
+/**
+ * Break the income or expense of a date range down by a dimension. The largest values are returned
+ * as items and the rest is summed as "Other". Each item is compared with the previous equivalent period
+ * @param query The query built by buildFilters
+ * @param from The start of the date range, in the timezone of the report
+ * @param to The end of the date range, excluded
+ * @param dimension The dimension to group by, see breakdownDimensions
+ * @param flow FlowExpense or FlowIncome
+ * @param limit The number of items before "Other"
+ * @return The report, error
+ */
+func getBreakdownReport(query map[string]interface{}, from time.Time, to time.Time, dimension string, flow string, limit int) (breakdownReport, error) {
+	field, ok := breakdownDimensions[dimension]
+	if !ok {
+		return breakdownReport{}, errors.New("invalid dimension")
+	}
+	previousFrom, previousTo := previousPeriod(from, to)
+
+	groups, err := sumByDimension(query, from, to, field, flow)
+	if err != nil {
+		return breakdownReport{}, err
+	}
+	previousGroups, err := sumByDimension(query, previousFrom, previousTo, field, flow)
+	if err != nil {
+		return breakdownReport{}, err
+	}
+
+	report := breakdownReport{Items: []breakdownItem{}, PreviousFrom: previousFrom, PreviousTo: previousTo}
+	previousTotals := make(map[string]float64)
+	for _, group := range previousGroups {
+		previousTotals[group.Key] = group.Total
+		report.PreviousTotal += group.Total
+	}
+	for _, group := range groups {
+		report.Total += group.Total
+		report.Count += group.Count
+	}
+
+	var other breakdownItem
+	for i, group := range groups {
+		if i < limit {
+			report.Items = append(report.Items, breakdownItem{
+				Key:           group.Key,
+				Total:         group.Total,
+				Count:         group.Count,
+				PreviousTotal: previousTotals[group.Key],
+			})
+			delete(previousTotals, group.Key)
+			continue
+		}
+		other.Total += group.Total
+		other.Count += group.Count
+		other.PreviousTotal += previousTotals[group.Key]
+		delete(previousTotals, group.Key)
+	}
+	if len(groups) > limit {
+		// Values that only appeared in the previous period also belong to "Other"
+		for _, previous := range previousTotals {
+			other.PreviousTotal += previous
+		}
+		other.Key = "Other"
+		report.Other = &other
+	}
+
+	for i := range report.Items {
+		compareBreakdownItem(&report.Items[i], report.Total)
+	}
+	if report.Other != nil {
+		compareBreakdownItem(report.Other, report.Total)
+	}
+	return report, nil
+}
+
+// balancePoint is the balance at the end of one period of a balance series
+type balancePoint struct {
+	Start   time.Time `json:"start"`
+	Label   string    `json:"label"`
+	Net     float64   `json:"net"`
+	Balance float64   `json:"balance"`
+}
+
+// balanceSeries is the running balance of a wallet, or of several wallets combined
+type balanceSeries struct {
+	// Nil for the combined series
+	Wallet *primitive.ObjectID `json:"wallet,omitempty"`
+	// The balance before the first period
+	Opening float64        `json:"opening"`
+	Points  []balancePoint `json:"points"`
+}
+
+// sumAmountsBefore returns the sum of the amounts of the entries matching the query dated before a time
+func sumAmountsBefore(query map[string]interface{}, before time.Time) (float64, error) {
+	match := bson.M{"date": bson.M{"$lt": before}}
+	for key, value := range query {
+		match[key] = value
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": "$amount"}}},
+	}
+	cursor, err := getEntriesColl().Aggregate(context.TODO(), pipeline, options.Aggregate().SetMaxTime(entryQueryTimeout))
+	if err != nil {
+		return 0, err
+	}
+	var results []struct {
+		Total float64 `bson:"total"`
+	}
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return 0, err
+	}
+	if len(results) == 0 {
+		return 0, nil
+	}
+	return results[0].Total, nil
+}
+
+/**
+ * Compute the running balance of the entries matching the query at the end of each period of a date range.
+ * The balance starts from the sum of all earlier entries, and each period adds the net of its entries,
+ * so that only one sum per period is read from the database
+ * @param query The query built by buildFilters
+ * @param from The start of the date range
+ * @param to The end of the date range, excluded
+ * @param period The length of the periods, see getPeriodReport
+ * @param location The timezone periods start in
+ * @return The series, error
+ */
+func getBalanceSeries(query map[string]interface{}, from time.Time, to time.Time, period string, location *time.Location) (balanceSeries, error) {
+	opening, err := sumAmountsBefore(query, from)
+	if err != nil {
+		return balanceSeries{}, err
+	}
+	buckets, err := getPeriodReport(query, from, to, period, location)
+	if err != nil {
+		return balanceSeries{}, err
+	}
+
+	series := balanceSeries{Opening: opening, Points: make([]balancePoint, 0, len(buckets))}
+	balance := opening
+	for _, bucket := range buckets {
+		balance += bucket.Net
+		series.Points = append(series.Points, balancePoint{
+			Start:   bucket.Start,
+			Label:   bucket.Label,
+			Net:     bucket.Net,
+			Balance: balance,
+		})
+	}
+	return series, nil
+}
+
+// combineBalanceSeries adds up series over the same periods
+func combineBalanceSeries(series []balanceSeries) balanceSeries {
+	combined := balanceSeries{Points: []balancePoint{}}
+	for i, s := range series {
+		combined.Opening += s.Opening
+		for j, point := range s.Points {
+			if i == 0 {
+				combined.Points = append(combined.Points, balancePoint{Start: point.Start, Label: point.Label})
+			}
+			combined.Points[j].Net += point.Net
+			combined.Points[j].Balance += point.Balance
+		}
+	}
+	return combined
+}
+
+// Periods a comparison report compares a date range with
+const (
+	CompareToPrevious     = "previous"
+	CompareToPreviousYear = "previous-year"
+)
+
+// A change is unusual when its modified z-score is above this threshold, as suggested by Iglewicz and Hoaglin
+const unusualChangeScore = 3.5
+
+// The minimum number of rows to tell unusual changes apart from the others
+const minRowsForUnusual = 4
+
+// comparisonRow compares a total of a date range with the same total of the compared range
+type comparisonRow struct {
+	Key string `json:"key"`
+	// The label of the aligned period in the compared range, for period rows
+	CompareKey    string   `json:"compareKey,omitempty"`
+	Current       float64  `json:"current"`
+	Previous      float64  `json:"previous"`
+	Change        float64  `json:"change"`
+	ChangePercent *float64 `json:"changePercent"`
+	Unusual       bool     `json:"unusual"`
+}
+
+// comparisonReport is the result of getComparisonReport
+type comparisonReport struct {
+	Buckets     []comparisonRow
+	Categories  []comparisonRow
+	Total       comparisonRow
+	CompareFrom time.Time
+	CompareTo   time.Time
+}
+
+func newComparisonRow(key string, compareKey string, current float64, previous float64) comparisonRow {
+	return comparisonRow{
+		Key:           key,
+		CompareKey:    compareKey,
+		Current:       current,
+		Previous:      previous,
+		Change:        current - previous,
+		ChangePercent: changePercent(previous, current),
+	}
+}
+
+// comparedRange returns the range a date range is compared with: the previous period of the same length,
+// see previousPeriod, or the same dates a year earlier
+func comparedRange(from time.Time, to time.Time, compareTo string) (time.Time, time.Time, error) {
+	switch compareTo {
+	case CompareToPrevious:
+		previousFrom, previousTo := previousPeriod(from, to)
+		return previousFrom, previousTo, nil
+	case CompareToPreviousYear:
+		return from.AddDate(-1, 0, 0), to.AddDate(-1, 0, 0), nil
+	}
+	return time.Time{}, time.Time{}, errors.New("invalid comparison")
+}
+
+// flowTotal returns the income or expense of a report bucket
+func flowTotal(bucket reportBucket, flow string) float64 {
+	if flow == FlowIncome {
+		return bucket.Income
+	}
+	return bucket.Expense
+}
+
+// median returns the median of the values, which are sorted in place
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
+
+/**
+ * Flag the rows whose change stands out from the changes of the other rows. Uses the modified z-score,
+ * which is based on the median absolute deviation so that the unusual changes themselves do not hide each other.
+ * When most changes are equal, the mean absolute deviation is used instead
+ * @param rows The rows, which are modified
+ */
+func flagUnusualChanges(rows []comparisonRow) {
+	if len(rows) < minRowsForUnusual {
+		return
+	}
+
+	changes := make([]float64, len(rows))
+	for i, row := range rows {
+		changes[i] = row.Change
+	}
+	center := median(changes)
+
+	deviations := make([]float64, len(rows))
+	meanDeviation := 0.0
+	for i, row := range rows {
+		deviations[i] = math.Abs(row.Change - center)
+		meanDeviation += deviations[i] / float64(len(rows))
+	}
+
+	// Scale the deviation to estimate the standard deviation of normally distributed changes
+	scale := median(deviations) / 0.6745
+	if scale == 0 {
+		scale = meanDeviation * 1.2533
+	}
+	if scale == 0 {
+		return
+	}
+	for i := range rows {
+		rows[i].Unusual = math.Abs(rows[i].Change-center)/scale > unusualChangeScore
+	}
+}
+
+/**
+ * Compare the income or expense of a date range with another range, side by side for each period and each category.
+ * Periods are aligned by position, so the first month of the range is compared with the first month of the other range
+ * @param query The query built by buildFilters
+ * @param from The start of the date range, in the timezone of the report
+ * @param to The end of the date range, excluded
+ * @param period The length of the periods, see getPeriodReport
+ * @param compareTo CompareToPrevious or CompareToPreviousYear
+ * @param flow FlowExpense or FlowIncome
+ * @param location The timezone periods start in
+ * @return The report, error
+ */
+func getComparisonReport(query map[string]interface{}, from time.Time, to time.Time, period string, compareTo string, flow string, location *time.Location) (comparisonReport, error) {
+	compareFrom, compareEnd, err := comparedRange(from, to, compareTo)
+	if err != nil {
+		return comparisonReport{}, err
+	}
+	report := comparisonReport{CompareFrom: compareFrom, CompareTo: compareEnd}
+
+	// Compare periods
+	buckets, err := getPeriodReport(query, from, to, period, location)
+	if err != nil {
+		return comparisonReport{}, err
+	}
+	compareBuckets, err := getPeriodReport(query, compareFrom, compareEnd, period, location)
+	if err != nil {
+		return comparisonReport{}, err
+	}
+	var total, compareTotal float64
+	for i := 0; i < len(buckets) || i < len(compareBuckets); i++ {
+		var key, compareKey string
+		var current, previous float64
+		if i < len(buckets) {
+			key = buckets[i].Label
+			current = flowTotal(buckets[i], flow)
+		}
+		if i < len(compareBuckets) {
+			compareKey = compareBuckets[i].Label
+			previous = flowTotal(compareBuckets[i], flow)
+		}
+		total += current
+		compareTotal += previous
+		report.Buckets = append(report.Buckets, newComparisonRow(key, compareKey, current, previous))
+	}
+	report.Total = newComparisonRow("total", "", total, compareTotal)
+
+	// Compare categories
+	groups, err := sumByDimension(query, from, to, "category", flow)
+	if err != nil {
+		return comparisonReport{}, err
+	}
+	compareGroups, err := sumByDimension(query, compareFrom, compareEnd, "category", flow)
+	if err != nil {
+		return comparisonReport{}, err
+	}
+	previousTotals := make(map[string]float64)
+	for _, group := range compareGroups {
+		previousTotals[group.Key] = group.Total
+	}
+	report.Categories = []comparisonRow{}
+	for _, group := range groups {
+		report.Categories = append(report.Categories, newComparisonRow(group.Key, "", group.Total, previousTotals[group.Key]))
+		delete(previousTotals, group.Key)
+	}
+	// Categories that only appeared in the compared range, in the order of their totals
+	for _, group := range compareGroups {
+		if previous, remaining := previousTotals[group.Key]; remaining {
+			report.Categories = append(report.Categories, newComparisonRow(group.Key, "", 0, previous))
+		}
+	}
+
+	flagUnusualChanges(report.Buckets)
+	flagUnusualChanges(report.Categories)
+	return report, nil
+}
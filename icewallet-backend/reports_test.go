@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlagUnusualChanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		changes     []float64
+		wantUnusual []bool
+	}{
+		{name: "too few rows", changes: []float64{0, 0, 1000}, wantUnusual: []bool{false, false, false}},
+		{name: "one spike", changes: []float64{10, 12, 9, 11, 10, 200},
+			wantUnusual: []bool{false, false, false, false, false, true}},
+		{name: "one drop", changes: []float64{-5, -3, -4, -6, -300},
+			wantUnusual: []bool{false, false, false, false, true}},
+		{name: "spikes in both directions", changes: []float64{1, 2, 1, 2, 100, 1, 2, -100},
+			wantUnusual: []bool{false, false, false, false, true, false, false, true}},
+		{name: "evenly spread", changes: []float64{10, 20, 30, 40, 50}, wantUnusual: []bool{false, false, false, false, false}},
+		{name: "no change", changes: []float64{5, 5, 5, 5}, wantUnusual: []bool{false, false, false, false}},
+		// Most changes are equal, so the median absolute deviation is zero
+		{name: "mostly equal", changes: []float64{0, 0, 0, 0, 0, 50},
+			wantUnusual: []bool{false, false, false, false, false, true}},
+		{name: "mostly equal with small differences", changes: []float64{0, 0, 0, 0, 1, 2},
+			wantUnusual: []bool{false, false, false, false, false, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows := make([]comparisonRow, len(test.changes))
+			for i, change := range test.changes {
+				rows[i] = newComparisonRow(string(rune('a'+i)), "", change, 0)
+			}
+			flagUnusualChanges(rows)
+			for i, row := range rows {
+				if row.Key != string(rune('a'+i)) || row.Change != test.changes[i] {
+					t.Fatalf("rows were reordered or changed: %+v", rows)
+				}
+				if row.Unusual != test.wantUnusual[i] {
+					t.Errorf("row %d with change %v: Unusual = %v, want %v", i, row.Change, row.Unusual, test.wantUnusual[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   float64
+	}{
+		{values: []float64{3}, want: 3},
+		{values: []float64{3, 1, 2}, want: 2},
+		{values: []float64{4, 1, 3, 2}, want: 2.5},
+		{values: []float64{-1, -1, 5, 5}, want: 2},
+	}
+	for _, test := range tests {
+		if got := median(append([]float64{}, test.values...)); got != test.want {
+			t.Errorf("median(%v) = %v, want %v", test.values, got, test.want)
+		}
+	}
+}
+
+func TestNewComparisonRow(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     float64
+		previous    float64
+		wantChange  float64
+		wantPercent *float64
+	}{
+		{name: "increase", current: 150, previous: 100, wantChange: 50, wantPercent: floatPtr(50)},
+		{name: "decrease", current: 75, previous: 100, wantChange: -25, wantPercent: floatPtr(-25)},
+		{name: "negative previous", current: -50, previous: -100, wantChange: 50, wantPercent: floatPtr(50)},
+		{name: "no previous", current: 20, previous: 0, wantChange: 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			row := newComparisonRow("2024-05", "2024-04", test.current, test.previous)
+			if row.Change != test.wantChange {
+				t.Errorf("Change = %v, want %v", row.Change, test.wantChange)
+			}
+			if (row.ChangePercent == nil) != (test.wantPercent == nil) ||
+				(row.ChangePercent != nil && *row.ChangePercent != *test.wantPercent) {
+				t.Errorf("ChangePercent = %v, want %v", row.ChangePercent, test.wantPercent)
+			}
+		})
+	}
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
+
+func TestComparedRange(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name      string
+		from      time.Time
+		to        time.Time
+		compareTo string
+		wantFrom  time.Time
+		wantTo    time.Time
+		wantErr   bool
+	}{
+		{name: "previous month", from: date(2024, 3, 1), to: date(2024, 4, 1), compareTo: CompareToPrevious,
+			wantFrom: date(2024, 2, 1), wantTo: date(2024, 3, 1)},
+		{name: "previous quarter", from: date(2024, 4, 1), to: date(2024, 7, 1), compareTo: CompareToPrevious,
+			wantFrom: date(2024, 1, 1), wantTo: date(2024, 4, 1)},
+		{name: "previous days", from: date(2024, 3, 10), to: date(2024, 3, 17), compareTo: CompareToPrevious,
+			wantFrom: date(2024, 3, 3), wantTo: date(2024, 3, 10)},
+		{name: "previous year", from: date(2024, 2, 1), to: date(2024, 3, 1), compareTo: CompareToPreviousYear,
+			wantFrom: date(2023, 2, 1), wantTo: date(2023, 3, 1)},
+		{name: "unknown comparison", from: date(2024, 2, 1), to: date(2024, 3, 1), compareTo: "next", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			from, to, err := comparedRange(test.from, test.to, test.compareTo)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("comparedRange() = %v - %v, want error", from, to)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("comparedRange() error = %v", err)
+			}
+			if !from.Equal(test.wantFrom) || !to.Equal(test.wantTo) {
+				t.Errorf("comparedRange() = %v - %v, want %v - %v", from, to, test.wantFrom, test.wantTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Revision actions
+const (
+	RevisionCreate  = "create"
+	RevisionUpdate  = "update"
+	RevisionDelete  = "delete"
+	RevisionRestore = "restore"
+)
+
+// The maximum number of changes that can be undone at once
+const maxUndoCount = 100
+
+// entryRevision is a version of an entry, recorded on every change. Before is nil for created entries
+type entryRevision struct {
+	Id       primitive.ObjectID `bson:"_id" json:"id"`
+	EntryId  primitive.ObjectID `bson:"entry" json:"entry"`
+	Wallet   primitive.ObjectID `bson:"wallet" json:"wallet"`
+	Revision int64              `bson:"revision" json:"revision"`
+	Action   string             `bson:"action" json:"action"`
+	UserId   primitive.ObjectID `bson:"user" json:"user"`
+	Before   bson.M             `bson:"before" json:"before"`
+	After    bson.M             `bson:"after" json:"after"`
+	Time     time.Time          `bson:"time" json:"time"`
+	Undone   bool               `bson:"undone" json:"undone"`
+}
+
+// toBsonMap converts a document to a map, so that revisions store entries in one form
+func toBsonMap(document interface{}) (bson.M, error) {
+	if document == nil {
+		return nil, nil
+	}
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var result bson.M
+	err = bson.Unmarshal(data, &result)
+	return result, err
+}
+
+/**
+ * Store a new revision of an entry. Failures are logged, since the change itself has already been made
+ * @param walletId The wallet of the entry
+ * @param entryId The changed entry
+ * @param userId The user making the change
+ * @param action One of the revision actions
+ * @param before The entry before the change, or nil if it was created
+ * @param after The entry after the change
+ */
+func recordRevision(walletId primitive.ObjectID, entryId primitive.ObjectID, userId primitive.ObjectID, action string, before interface{}, after interface{}) {
+	err := insertRevision(walletId, entryId, userId, action, before, after)
+	if err != nil {
+		log.Println("Failed to record revision:", err)
+	}
+}
+
+func insertRevision(walletId primitive.ObjectID, entryId primitive.ObjectID, userId primitive.ObjectID, action string, before interface{}, after interface{}) error {
+	beforeMap, err := toBsonMap(before)
+	if err != nil {
+		return err
+	}
+	afterMap, err := toBsonMap(after)
+	if err != nil {
+		return err
+	}
+
+	// Every change increases the version of the entry atomically, so the version after the change
+	// numbers the revision without racing with concurrent changes. Undos increase the version
+	// without a revision, which leaves gaps in the numbers
+	_, err = getRevisionsColl().InsertOne(context.TODO(), entryRevision{
+		Id:       primitive.NewObjectID(),
+		EntryId:  entryId,
+		Wallet:   walletId,
+		Revision: entryVersion(afterMap),
+		Action:   action,
+		UserId:   userId,
+		Before:   beforeMap,
+		After:    afterMap,
+		Time:     time.Now(),
+	})
+	return err
+}
+
+// findEntryRevisions returns every revision of an entry, oldest first
+func findEntryRevisions(walletId primitive.ObjectID, entryId string) ([]entryRevision, error) {
+	id, err := primitive.ObjectIDFromHex(entryId)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := getRevisionsColl().Find(context.TODO(), bson.M{"entry": id, "wallet": walletId},
+		options.Find().SetSort(bson.M{"revision": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []entryRevision
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = []entryRevision{}
+	}
+	return results, nil
+}
+
+/**
+ * Revert the last changes made to the entries of a wallet, newest first. All changes are
+ * reverted in one transaction where the server supports it. Undone revisions are marked as such
+ * and are skipped by later undos
+ * @param walletId The wallet
+ * @param count The number of changes to undo
+ * @return The undone revisions, error
+ */
+func undoChanges(walletId primitive.ObjectID, count int64) ([]entryRevision, error) {
+	if count <= 0 || count > maxUndoCount {
+		return nil, errors.New("invalid number of changes")
+	}
+
+	var undone []entryRevision
+	err := runTransaction(func(ctx context.Context) error {
+		cursor, err := getRevisionsColl().Find(ctx, bson.M{"wallet": walletId, "undone": false},
+			options.Find().SetSort(bson.M{"_id": -1}).SetLimit(count))
+		if err != nil {
+			return err
+		}
+		undone = nil
+		if err = cursor.All(ctx, &undone); err != nil {
+			return err
+		}
+
+		ids := make([]primitive.ObjectID, 0, len(undone))
+		for _, rev := range undone {
+			if rev.Before == nil {
+				// The entry did not exist before it was created
+				_, err = getEntriesColl().DeleteOne(ctx, bson.M{"_id": rev.EntryId, "wallet": walletId})
+			} else {
+				// The version keeps increasing from the stored one, so that copies read before the undo are outdated.
+				// Undoing several changes of one entry reads the version the previous undo stored
+				var current bson.M
+				err = getEntriesColl().FindOne(ctx, bson.M{"_id": rev.EntryId, "wallet": walletId},
+					options.FindOne().SetProjection(bson.M{"version": 1})).Decode(&current)
+				if err != nil && err != mongo.ErrNoDocuments {
+					return err
+				}
+				version := entryVersion(rev.After)
+				if entryVersion(current) > version {
+					version = entryVersion(current)
+				}
+				replacement := bson.M{}
+				for key, value := range rev.Before {
+					replacement[key] = value
+				}
+				replacement["version"] = version + 1
+				_, err = getEntriesColl().ReplaceOne(ctx, bson.M{"_id": rev.EntryId, "wallet": walletId}, replacement,
+					options.Replace().SetUpsert(true))
+			}
+			if err != nil {
+				return err
+			}
+			ids = append(ids, rev.Id)
+		}
+
+		_, err = getRevisionsColl().UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{
+			"$set": bson.M{"undone": true},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if undone == nil {
+		undone = []entryRevision{}
+	}
+	return undone, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The maximum number of saved filters of a user
+const maxSavedFilters = 100
+
+// savedFilter is a named filter preset of a user, stored as a meta document. Filter and sort are the
+// fields of a /getEntries body, kept as sent so that relative dates such as "now-90d" are resolved when used
+type savedFilter struct {
+	Id         primitive.ObjectID `json:"id"`
+	Name       string             `json:"name"`
+	Filter     []interface{}      `json:"filter"`
+	Sort       interface{}        `json:"sort,omitempty"`
+	Search     string             `json:"search,omitempty"`
+	CreateTime time.Time          `json:"createTime"`
+}
+
+// toJsonValue converts a value read from the database to the types of a decoded JSON body,
+// which parseFiltersFromHttpBody and parseEntrySort expect
+func toJsonValue(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var result interface{}
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+// decodeSavedFilter reads a saved filter from its meta document
+func decodeSavedFilter(document bson.M) (savedFilter, error) {
+	filter, err := toJsonValue(document["filter"])
+	if err != nil {
+		return savedFilter{}, err
+	}
+	sort, err := toJsonValue(document["sort"])
+	if err != nil {
+		return savedFilter{}, err
+	}
+
+	result := savedFilter{Sort: sort}
+	result.Id, _ = document["_id"].(primitive.ObjectID)
+	result.Name, _ = document["name"].(string)
+	result.Filter, _ = filter.([]interface{})
+	result.Search, _ = document["search"].(string)
+	if createTime, ok := document["createTime"].(primitive.DateTime); ok {
+		result.CreateTime = createTime.Time()
+	}
+	if result.Filter == nil {
+		result.Filter = []interface{}{}
+	}
+	return result, nil
+}
+
+/**
+ * Save a filter preset for the user
+ * @param userId The owner of the filter
+ * @param name A name to recognize the filter by
+ * @param filter An array of entryFilter objects, see /getEntries
+ * @param sort The sort, see parseEntrySort, or nil for the default
+ * @param search Words to search for, see addSearchToQuery
+ * @return The saved filter, error if the filter is invalid
+ */
+func createSavedFilter(userId primitive.ObjectID, name string, filter []interface{}, sort interface{}, search string) (savedFilter, error) {
+	if name == "" {
+		return savedFilter{}, errors.New("name is required")
+	}
+	if _, err := parseFiltersFromHttpBody(map[string]interface{}{"filter": filter}); err != nil {
+		return savedFilter{}, err
+	}
+	if _, err := parseEntrySort(sort); err != nil {
+		return savedFilter{}, err
+	}
+	if _, err := addSearchToQuery(bson.M{}, search); err != nil {
+		return savedFilter{}, err
+	}
+
+	count, err := getMetaColl().CountDocuments(context.TODO(), bson.M{"type": "savedFilter", "user": userId})
+	if err != nil {
+		return savedFilter{}, err
+	}
+	if count >= maxSavedFilters {
+		return savedFilter{}, errors.New("too many saved filters")
+	}
+
+	result := savedFilter{
+		Id:         primitive.NewObjectID(),
+		Name:       name,
+		Filter:     filter,
+		Sort:       sort,
+		Search:     search,
+		CreateTime: time.Now(),
+	}
+	_, err = getMetaColl().InsertOne(context.TODO(), bson.M{
+		"_id":        result.Id,
+		"type":       "savedFilter",
+		"user":       userId,
+		"name":       result.Name,
+		"filter":     result.Filter,
+		"sort":       result.Sort,
+		"search":     result.Search,
+		"createTime": result.CreateTime,
+	})
+	if err != nil {
+		return savedFilter{}, err
+	}
+	return result, nil
+}
+
+func getSavedFilters(userId primitive.ObjectID) ([]savedFilter, error) {
+	cursor, err := getMetaColl().Find(context.TODO(), bson.M{"type": "savedFilter", "user": userId})
+	if err != nil {
+		return nil, err
+	}
+
+	var documents []bson.M
+	if err = cursor.All(context.Background(), &documents); err != nil {
+		return nil, err
+	}
+	results := make([]savedFilter, 0, len(documents))
+	for _, document := range documents {
+		result, err := decodeSavedFilter(document)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// findSavedFilter finds a saved filter of the user. Returns mongo.ErrNoDocuments if it does not exist
+func findSavedFilter(userId primitive.ObjectID, filterId string) (savedFilter, error) {
+	id, err := primitive.ObjectIDFromHex(filterId)
+	if err != nil {
+		return savedFilter{}, mongo.ErrNoDocuments
+	}
+
+	var document bson.M
+	err = getMetaColl().FindOne(context.TODO(), bson.M{"_id": id, "type": "savedFilter", "user": userId}).Decode(&document)
+	if err != nil {
+		return savedFilter{}, err
+	}
+	return decodeSavedFilter(document)
+}
+
+func deleteSavedFilter(userId primitive.ObjectID, filterId string) error {
+	id, err := primitive.ObjectIDFromHex(filterId)
+	if err != nil {
+		return err
+	}
+
+	result, err := getMetaColl().DeleteOne(context.TODO(), bson.M{"_id": id, "type": "savedFilter", "user": userId})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+/**
+ * Apply the saved filter referenced by the "savedFilter" field of a request body. The filters of the
+ * saved filter are added to those of the body, and its sort and search are used unless the body has its own
+ * @param userId The user making the request, who must own the saved filter
+ * @param body The request body, which is modified
+ * @return mongo.ErrNoDocuments if the saved filter does not exist, other errors if the body is invalid
+ */
+func applySavedFilter(userId primitive.ObjectID, body map[string]interface{}) error {
+	if body["savedFilter"] == nil {
+		return nil
+	}
+	filterId, ok := body["savedFilter"].(string)
+	if !ok {
+		return errors.New("invalid saved filter id")
+	}
+	saved, err := findSavedFilter(userId, filterId)
+	if err != nil {
+		return err
+	}
+
+	filter := append([]interface{}{}, saved.Filter...)
+	if body["filter"] != nil {
+		extra, ok := body["filter"].([]interface{})
+		if !ok {
+			return errors.New("invalid filter")
+		}
+		filter = append(filter, extra...)
+	}
+	body["filter"] = filter
+	if body["sort"] == nil && saved.Sort != nil {
+		body["sort"] = saved.Sort
+	}
+	if body["search"] == nil && saved.Search != "" {
+		body["search"] = saved.Search
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Fields covered by the search, which share the text index of the entries collection
+var searchFields = []string{"description", "notes"}
+
+// The sort field of the search relevance, only available when searching whole words
+const relevanceField = "score"
+
+// Limits of a search
+const (
+	maxSearchLength = 200
+	maxSearchTerms  = 10
+)
+
+// The maximum length of a user-supplied regular expression
+const maxRegexLength = 100
+
+// Time limit of entry queries, which bounds the cost of user-supplied regular expressions
+const entryQueryTimeout = 5 * time.Second
+
+// MongoDB error code of queries that exceed their time limit
+const maxTimeExpiredCode = 50
+
+// escapeRegex escapes a value so that it matches literally in a $regex
+func escapeRegex(value string) string {
+	return regexp.QuoteMeta(value)
+}
+
+/**
+ * Add a search to an entry query. Words of the search are matched as whole words through the
+ * text index, in any form the language stemming gives them, and are ranked by relevance.
+ * Words ending with * match any word starting with them, e.g. "groc*" matches "groceries".
+ * A phrase in double quotes must appear as is
+ * @param query The query built by buildFilters
+ * @param search The search
+ * @return Whether the search uses the text index, and so supports sorting by relevance, error
+ */
+func addSearchToQuery(query map[string]interface{}, search string) (bool, error) {
+	search = strings.TrimSpace(search)
+	if search == "" {
+		return false, nil
+	}
+	if len(search) > maxSearchLength {
+		return false, errors.New("search is too long")
+	}
+
+	// Phrases in double quotes are passed to the text search as is
+	var textTerms []string
+	var prefixes []string
+	parts := strings.Split(search, "\"")
+	for i, part := range parts {
+		if i%2 == 1 {
+			if phrase := strings.TrimSpace(part); phrase != "" {
+				textTerms = append(textTerms, "\""+phrase+"\"")
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			// Negations and other text search syntax are not supported, so words are taken literally
+			word = strings.TrimLeft(word, "-")
+			if strings.HasSuffix(word, "*") {
+				if prefix := strings.TrimRight(word, "*"); prefix != "" {
+					prefixes = append(prefixes, prefix)
+				}
+			} else if word != "" {
+				textTerms = append(textTerms, word)
+			}
+		}
+	}
+	if len(textTerms)+len(prefixes) > maxSearchTerms {
+		return false, errors.New("too many search terms")
+	}
+
+	conditions, _ := query["$and"].([]map[string]interface{})
+	for _, prefix := range prefixes {
+		fieldConditions := make([]bson.M, 0, len(searchFields))
+		for _, field := range searchFields {
+			fieldConditions = append(fieldConditions, bson.M{field: bson.M{
+				"$regex":   `\b` + escapeRegex(prefix),
+				"$options": "i",
+			}})
+		}
+		conditions = append(conditions, map[string]interface{}{"$or": fieldConditions})
+	}
+	if len(conditions) > 0 {
+		query["$and"] = conditions
+	}
+
+	if len(textTerms) == 0 {
+		return false, nil
+	}
+	query["$text"] = bson.M{"$search": strings.Join(textTerms, " ")}
+	return true, nil
+}
+
+// hasNestedRepeat checks whether a repetition contains another repetition, such as (a+)+,
+// which can take exponential time to match with a backtracking regex engine
+func hasNestedRepeat(re *syntax.Regexp, inRepeat bool) bool {
+	isRepeat := re.Op == syntax.OpStar || re.Op == syntax.OpPlus || re.Op == syntax.OpRepeat
+	if isRepeat && inRepeat {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasNestedRepeat(sub, inRepeat || isRepeat) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUserRegex checks a regular expression supplied by a user before it is sent to the database.
+// Only the syntax shared by Go and MongoDB is accepted, which excludes backreferences and lookarounds,
+// and nested repetitions are rejected. Queries are also limited to entryQueryTimeout
+func validateUserRegex(pattern string) error {
+	if pattern == "" || len(pattern) > maxRegexLength {
+		return errors.New("invalid regular expression length")
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return errors.New("invalid regular expression")
+	}
+	if hasNestedRepeat(re, false) {
+		return errors.New("nested repetitions are not allowed in regular expressions")
+	}
+	return nil
+}
+
+// isQueryTimeout checks whether a query failed by exceeding its time limit
+func isQueryTimeout(err error) bool {
+	if serverErr, ok := err.(mongo.ServerError); ok && serverErr.HasErrorCode(maxTimeExpiredCode) {
+		return true
+	}
+	return mongo.IsTimeout(err)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidateUserRegex(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{pattern: "^coffee"},
+		{pattern: "(?i)groc(ery|eries)$"},
+		{pattern: `\d{2,4}-\w+`},
+		{pattern: "[a-z]+ [0-9]*"},
+		{pattern: "(ab)+c"},
+		{pattern: "", wantErr: true},
+		{pattern: strings.Repeat("a", maxRegexLength+1), wantErr: true},
+		{pattern: "(unclosed", wantErr: true},
+		{pattern: "[z-a]", wantErr: true},
+		{pattern: `(a)\1`, wantErr: true},
+		{pattern: "(?=a)b", wantErr: true},
+		{pattern: "(?<!a)b", wantErr: true},
+		{pattern: "(a+)+", wantErr: true},
+		{pattern: "(a*)*b", wantErr: true},
+		{pattern: "(?:a|b+){2,}", wantErr: true},
+		{pattern: "((ab)*c)+", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			err := validateUserRegex(test.pattern)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateUserRegex() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestEscapeRegex(t *testing.T) {
+	for _, value := range []string{"C++", "(draft)", "$5.00", "a|b", `back\slash`, "[x]*?"} {
+		re := regexp.MustCompile("^" + escapeRegex(value) + "$")
+		if !re.MatchString(value) {
+			t.Errorf("escapeRegex(%q) = %q does not match the value literally", value, escapeRegex(value))
+		}
+	}
+}
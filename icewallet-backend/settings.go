@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// userSettings is the meta document holding the preferences of a user
+type userSettings struct {
+	// IANA timezone reports and relative dates use, empty for the server default
+	Timezone string `bson:"timezone" json:"timezone"`
+}
+
+// findUserSettings returns the settings of the user, which are empty if the user has not changed any
+func findUserSettings(userId primitive.ObjectID) (userSettings, error) {
+	var result userSettings
+	err := getMetaColl().FindOne(context.TODO(), bson.M{"type": "settings", "user": userId}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return userSettings{}, nil
+	}
+	return result, err
+}
+
+// setUserTimezone sets the timezone of the user. An empty timezone reverts to the server default
+func setUserTimezone(userId primitive.ObjectID, timezone string) error {
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return errors.New("invalid timezone")
+		}
+	}
+
+	_, err := getMetaColl().UpdateOne(context.TODO(), bson.M{"type": "settings", "user": userId}, bson.M{
+		"$set": bson.M{"timezone": timezone},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+/**
+ * Find the timezone of a request. An explicit timezone overrides the user's timezone,
+ * which overrides the server default
+ * @param userId The user making the request
+ * @param override The timezone field of the request body, or nil
+ * @return The timezone, error if the override is invalid
+ */
+func findUserLocation(userId primitive.ObjectID, override interface{}) (*time.Location, error) {
+	if override != nil {
+		return parseTimezone(override)
+	}
+
+	settings, err := findUserSettings(userId)
+	if err != nil {
+		return nil, err
+	}
+	if settings.Timezone == "" {
+		return defaultLocation, nil
+	}
+	location, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		return defaultLocation, nil
+	}
+	return location, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults understood by all authenticator apps
+const (
+	totpIssuer        = "Ice Wallet"
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+// Logins waiting for the second factor, keyed by ticket
+var pendingTwoFactorLogins = newExpiringStore(5 * time.Minute)
+
+// twoFactorTicket is a login whose password has been verified
+type twoFactorTicket struct {
+	userId   primitive.ObjectID
+	attempts int
+	// Retries keep the expiry of the ticket from the login
+	expires time.Time
+}
+
+// Maximum number of wrong codes that can be submitted for one login ticket
+const maxTwoFactorAttempts = 3
+
+// totpSettings is the meta document holding the TOTP secret and hashed recovery codes of a user
+type totpSettings struct {
+	Secret        string   `bson:"secret"`
+	Enabled       bool     `bson:"enabled"`
+	LastStep      int64    `bson:"lastStep"`
+	RecoveryCodes []string `bson:"recoveryCodes"`
+}
+
+/**
+ * Compute an HOTP value (RFC 4226)
+ * @param secret The shared secret
+ * @param counter The moving factor, which is the time step for TOTP
+ * @return The zero-padded code
+ */
+func computeHotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+func decodeTotpSecret(secret string) ([]byte, error) {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+}
+
+/**
+ * Check a TOTP code against the secret, allowing a clock skew of totpSkew steps
+ * @return The time step the code belongs to, and whether the code is valid
+ */
+func checkTotpCode(secret string, code string, now time.Time) (int64, bool) {
+	key, err := decodeTotpSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.TrimSpace(code)
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(computeHotp(key, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// getTotpProvisioningUri returns the otpauth:// URI to be rendered as a QR code for authenticator apps
+func getTotpProvisioningUri(secret string, username string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + params.Encode()
+}
+
+func findTotpSettings(userId primitive.ObjectID) (totpSettings, error) {
+	var result totpSettings
+	err := getMetaColl().FindOne(context.TODO(), bson.M{"type": "totp", "user": userId}).Decode(&result)
+	return result, err
+}
+
+func isTotpEnabled(userId primitive.ObjectID) bool {
+	settings, err := findTotpSettings(userId)
+	return err == nil && settings.Enabled
+}
+
+/**
+ * Start TOTP enrollment by generating a new secret. The secret is only used for login
+ * once confirmed with confirmTotpEnrollment
+ * @return The base32 secret, and the provisioning URI
+ */
+func beginTotpEnrollment(user walletUser) (string, string, error) {
+	if isTotpEnabled(user.Id) {
+		return "", "", errors.New("two-factor authentication is already enabled")
+	}
+
+	key := make([]byte, 20)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", "", err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+
+	_, err = getMetaColl().UpdateOne(context.TODO(), bson.M{"type": "totp", "user": user.Id}, bson.M{
+		"$set": bson.M{
+			"secret":        secret,
+			"enabled":       false,
+			"lastStep":      int64(0),
+			"recoveryCodes": []string{},
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return "", "", err
+	}
+
+	return secret, getTotpProvisioningUri(secret, user.Username), nil
+}
+
+/**
+ * Finish TOTP enrollment by verifying a code from the authenticator app
+ * @return The plain recovery codes, which are only stored hashed
+ */
+func confirmTotpEnrollment(userId primitive.ObjectID, code string) ([]string, error) {
+	settings, err := findTotpSettings(userId)
+	if err != nil {
+		return nil, errors.New("two-factor enrollment has not been started")
+	}
+	if settings.Enabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	step, ok := checkTotpCode(settings.Secret, code, time.Now())
+	if !ok {
+		return nil, errors.New("invalid code")
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = getMetaColl().UpdateOne(context.TODO(), bson.M{"type": "totp", "user": userId}, bson.M{
+		"$set": bson.M{
+			"enabled":       true,
+			"lastStep":      step,
+			"recoveryCodes": hashes,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateSecureRandomString(10)
+		if err != nil {
+			return nil, nil, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code
+		hashes[i] = string(hash)
+	}
+	return codes, hashes, nil
+}
+
+/**
+ * Verify the second factor, which is either a TOTP code or an unused recovery code.
+ * A TOTP code can only be used once, and a recovery code is removed once used
+ */
+func verifySecondFactor(userId primitive.ObjectID, code string) bool {
+	settings, err := findTotpSettings(userId)
+	if err != nil || !settings.Enabled {
+		return false
+	}
+
+	// TOTP code. Only accept steps after the last used one to prevent replay
+	if step, ok := checkTotpCode(settings.Secret, code, time.Now()); ok {
+		result, err := getMetaColl().UpdateOne(context.TODO(), bson.M{
+			"type":     "totp",
+			"user":     userId,
+			"lastStep": bson.M{"$lt": step},
+		}, bson.M{
+			"$set": bson.M{"lastStep": step},
+		})
+		return err == nil && result.ModifiedCount == 1
+	}
+
+	// Recovery code
+	for _, hash := range settings.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(strings.TrimSpace(code))) == nil {
+			result, err := getMetaColl().UpdateOne(context.TODO(), bson.M{"type": "totp", "user": userId}, bson.M{
+				"$pull": bson.M{"recoveryCodes": hash},
+			})
+			return err == nil && result.ModifiedCount == 1
+		}
+	}
+
+	return false
+}
+
+func disableTotp(userId primitive.ObjectID) error {
+	_, err := getMetaColl().DeleteOne(context.TODO(), bson.M{"type": "totp", "user": userId})
+	return err
+}
+
+// createTwoFactorTicket registers a login whose password has been verified and
+// which is waiting for the second factor
+func createTwoFactorTicket(userId primitive.ObjectID) (string, error) {
+	ticket, err := generateSecureRandomString(32)
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(pendingTwoFactorLogins.ttl)
+	pendingTwoFactorLogins.putUntil(ticket, twoFactorTicket{userId: userId, expires: expires}, expires)
+	return ticket, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The secret of the RFC 4226 and RFC 6238 test vectors, "12345678901234567890", in base32
+const rfcTotpSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestComputeHotp(t *testing.T) {
+	// RFC 4226 appendix D
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range expected {
+		if got := computeHotp([]byte("12345678901234567890"), uint64(counter)); got != code {
+			t.Errorf("computeHotp(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestCheckTotpCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		unix     int64
+		wantStep int64
+		wantOk   bool
+	}{
+		// RFC 6238 appendix B, truncated to 6 digits
+		{name: "rfc 59", secret: rfcTotpSecret, code: "287082", unix: 59, wantStep: 1, wantOk: true},
+		{name: "rfc 1111111109", secret: rfcTotpSecret, code: "081804", unix: 1111111109, wantStep: 37037036, wantOk: true},
+		{name: "rfc 1234567890", secret: rfcTotpSecret, code: "005924", unix: 1234567890, wantStep: 41152263, wantOk: true},
+		{name: "rfc 2000000000", secret: rfcTotpSecret, code: "279037", unix: 2000000000, wantStep: 66666666, wantOk: true},
+		{name: "lowercase secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code: "287082", unix: 59, wantStep: 1, wantOk: true},
+		{name: "surrounding spaces", secret: rfcTotpSecret, code: " 287082 ", unix: 59, wantStep: 1, wantOk: true},
+		{name: "previous step", secret: rfcTotpSecret, code: "287082", unix: 59 + totpPeriod, wantStep: 1, wantOk: true},
+		{name: "next step", secret: rfcTotpSecret, code: "287082", unix: 59 - totpPeriod, wantStep: 1, wantOk: true},
+		{name: "outside the window", secret: rfcTotpSecret, code: "287082", unix: 59 + 2*totpPeriod},
+		{name: "wrong code", secret: rfcTotpSecret, code: "287083", unix: 59},
+		{name: "empty code", secret: rfcTotpSecret, code: "", unix: 59},
+		{name: "invalid secret", secret: "not base32!", code: "287082", unix: 59},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := checkTotpCode(test.secret, test.code, time.Unix(test.unix, 0))
+			if ok != test.wantOk || step != test.wantStep {
+				t.Errorf("checkTotpCode() = %d, %v, want %d, %v", step, ok, test.wantStep, test.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How often trashed entries past the retention period are purged
+const trashPurgeInterval = time.Hour
+
+// findTrashedEntries returns the trashed entries of a wallet, most recently deleted first
+func findTrashedEntries(walletId primitive.ObjectID, start int64, limit int64) ([]bson.M, int64, error) {
+	query := bson.M{"wallet": walletId, "deletedAt": bson.M{"$exists": true}}
+	count, err := getEntriesColl().CountDocuments(context.TODO(), query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor, err := getEntriesColl().Find(context.TODO(), query, options.Find().
+		SetSort(bson.M{"deletedAt": -1}).
+		SetSkip(start).
+		SetLimit(limit))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var results []bson.M
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, 0, err
+	}
+	if results == nil {
+		results = []bson.M{}
+	}
+	return results, count, nil
+}
+
+/**
+ * Restore an entry from the trash
+ * @return The entry before and after restoring, error (mongo.ErrNoDocuments if the entry is not in the trash)
+ */
+func restoreEntry(walletId primitive.ObjectID, entryId string) (bson.M, bson.M, error) {
+	id, err := primitive.ObjectIDFromHex(entryId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var before bson.M
+	err = getEntriesColl().FindOneAndUpdate(context.TODO(), bson.M{
+		"_id":       id,
+		"wallet":    walletId,
+		"deletedAt": bson.M{"$exists": true},
+	}, bson.M{
+		"$unset": bson.M{"deletedAt": ""},
+		"$inc":   bson.M{"version": 1},
+	}).Decode(&before)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	after := bson.M{}
+	for key, value := range before {
+		if key != "deletedAt" {
+			after[key] = value
+		}
+	}
+	after["version"] = entryVersion(before) + 1
+	return before, after, nil
+}
+
+// purgeTrash permanently deletes entries that have been in the trash for longer than the retention period
+func purgeTrash(retention time.Duration) (int64, error) {
+	result, err := getEntriesColl().DeleteMany(context.TODO(), bson.M{
+		"deletedAt": bson.M{"$lt": time.Now().Add(-retention)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// startTrashPurge purges the trash periodically in the background. The retention period
+// is read from TRASH_RETENTION_DAYS, a value of 0 or less keeps trashed entries forever
+func startTrashPurge() {
+	retentionDays := getEnvInt("TRASH_RETENTION_DAYS", 30)
+	if retentionDays <= 0 {
+		log.Println("Trashed entries are kept forever")
+		return
+	}
+	retention := time.Duration(retentionDays) * 24 * time.Hour
+
+	go func() {
+		for {
+			count, err := purgeTrash(retention)
+			if err != nil {
+				log.Println("Failed to purge trash:", err)
+			} else if count > 0 {
+				log.Printf("Purged %d trashed entries", count)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type walletUser struct {
+	Id         primitive.ObjectID `bson:"_id" json:"id"`
+	Username   string             `bson:"username" json:"username"`
+	Password   string             `bson:"password" json:"-"`
+	CreateTime time.Time          `bson:"createTime" json:"createTime"`
+}
+
+// Compared against when the username does not exist, so that failed logins
+// take the same time whether or not the username exists
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("icewallet"), bcrypt.DefaultCost)
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func checkUsersExist() bool {
+	count, err := getUsersColl().CountDocuments(context.TODO(), bson.M{})
+	return err == nil && count > 0
+}
+
+func findUserByName(username string) (walletUser, error) {
+	var result walletUser
+	err := getUsersColl().FindOne(context.TODO(), bson.M{"username": normalizeUsername(username)}).Decode(&result)
+	return result, err
+}
+
+func findUserById(userId primitive.ObjectID) (walletUser, error) {
+	var result walletUser
+	err := getUsersColl().FindOne(context.TODO(), bson.M{"_id": userId}).Decode(&result)
+	return result, err
+}
+
+func getUsers() ([]walletUser, error) {
+	cursor, err := getUsersColl().Find(context.TODO(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []walletUser
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+/**
+ * Create a new user
+ * @param username The username, which is case insensitive
+ * @param password The plain password
+ * @return The id of the new user, error
+ */
+func addUser(username string, password string) (primitive.ObjectID, error) {
+	username = normalizeUsername(username)
+	if username == "" {
+		return primitive.NilObjectID, errors.New("username cannot be empty")
+	}
+	if _, err := findUserByName(username); err == nil {
+		return primitive.NilObjectID, errors.New("username already exists")
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	user := walletUser{
+		Id:         primitive.NewObjectID(),
+		Username:   username,
+		Password:   string(hashedPassword),
+		CreateTime: time.Now(),
+	}
+	_, err = getUsersColl().InsertOne(context.TODO(), user)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	_, err = createWallet(user.Id, "Personal", true)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return user.Id, nil
+}
+
+// removeUser deletes a user together with their tokens, API keys and settings. Wallets shared
+// with other users are kept, other wallets are deleted with their entries
+func removeUser(username string) error {
+	user, err := findUserByName(username)
+	if err != nil {
+		return err
+	}
+
+	err = removeUserFromWallets(user.Id)
+	if err != nil {
+		return err
+	}
+	_, err = getTokensColl().DeleteMany(context.TODO(), bson.M{"user": user.Id})
+	if err != nil {
+		return err
+	}
+	_, err = getApiKeysColl().DeleteMany(context.TODO(), bson.M{"user": user.Id})
+	if err != nil {
+		return err
+	}
+	_, err = getMetaColl().DeleteMany(context.TODO(), bson.M{"user": user.Id})
+	if err != nil {
+		return err
+	}
+	_, err = getUsersColl().DeleteOne(context.TODO(), bson.M{"_id": user.Id})
+	return err
+}
+
+func changePassword(userId primitive.ObjectID, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	result, err := getUsersColl().UpdateOne(context.TODO(), bson.M{"_id": userId}, bson.M{
+		"$set": bson.M{"password": string(hashedPassword)},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+/**
+ * Check the password of a user
+ * @param username The username
+ * @param password The plain password
+ * @return The user, and whether the username exists and the password is correct
+ */
+func verifyPassword(username string, password string) (walletUser, bool) {
+	user, err := findUserByName(username)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return walletUser{}, false
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	return user, err == nil
+}
+
+/**
+ * Migrate a single-user database to the multi-user layout. The password document in
+ * meta becomes the user "admin", which owns all existing entries and settings.
+ * Does nothing if users already exist or there is no password document
+ */
+func migrateSingleUser() error {
+	if checkUsersExist() {
+		return nil
+	}
+
+	var passwordDoc bson.M
+	err := getMetaColl().FindOne(context.TODO(), bson.M{"type": "password"}).Decode(&passwordDoc)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Println("Migrating single-user data to user \"admin\"...")
+	user := walletUser{
+		Id:         primitive.NewObjectID(),
+		Username:   "admin",
+		Password:   passwordDoc["password"].(string),
+		CreateTime: time.Now(),
+	}
+	_, err = getUsersColl().InsertOne(context.TODO(), user)
+	if err != nil {
+		return err
+	}
+
+	// Assign existing data to the user
+	_, err = getEntriesColl().UpdateMany(context.TODO(), bson.M{"owner": bson.M{"$exists": false}}, bson.M{
+		"$set": bson.M{"owner": user.Id},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = getMetaColl().UpdateMany(context.TODO(), bson.M{
+		"type": bson.M{"$in": []string{"totp", "passkey"}},
+		"user": bson.M{"$exists": false},
+	}, bson.M{
+		"$set": bson.M{"user": user.Id},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Tokens issued before the migration are not bound to a user
+	_, err = getTokensColl().DeleteMany(context.TODO(), bson.M{"user": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+
+	_, err = getMetaColl().DeleteOne(context.TODO(), bson.M{"type": "password"})
+	return err
+}
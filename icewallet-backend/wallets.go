@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Wallet roles. Each role includes the permissions of the roles before it
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+var errWalletForbidden = errors.New("no permission on this wallet")
+
+// How long an invitation code can be used for
+const invitationTtl = 7 * 24 * time.Hour
+
+// wallet is a container of entries shared by its members
+type wallet struct {
+	Id         primitive.ObjectID  `bson:"_id" json:"id"`
+	Name       string              `bson:"name" json:"name"`
+	Members    []walletMember      `bson:"members" json:"members"`
+	PersonalOf *primitive.ObjectID `bson:"personalOf,omitempty" json:"personal,omitempty"`
+	CreateTime time.Time           `bson:"createTime" json:"createTime"`
+}
+
+type walletMember struct {
+	UserId primitive.ObjectID `bson:"user" json:"user"`
+	Role   string             `bson:"role" json:"role"`
+}
+
+// roleIncludes checks whether a role grants the permissions of the required role
+func roleIncludes(role string, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+func findWallet(walletId primitive.ObjectID) (wallet, error) {
+	var result wallet
+	err := getWalletsColl().FindOne(context.TODO(), bson.M{"_id": walletId}).Decode(&result)
+	return result, err
+}
+
+// getMemberRole returns the role of the user in the wallet, or an empty string if not a member
+func getMemberRole(w wallet, userId primitive.ObjectID) string {
+	for _, member := range w.Members {
+		if member.UserId == userId {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+// getUserWallets returns the wallets the user is a member of
+func getUserWallets(userId primitive.ObjectID) ([]wallet, error) {
+	cursor, err := getWalletsColl().Find(context.TODO(), bson.M{"members.user": userId}, options.Find().SetSort(bson.M{"createTime": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []wallet
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+	if results == nil {
+		return []wallet{}, nil
+	}
+	return results, nil
+}
+
+/**
+ * Create a wallet owned by the user
+ * @param userId The owner of the wallet
+ * @param name The name of the wallet
+ * @param personal Whether this is the user's personal wallet, used when a request does not specify a wallet
+ * @return The id of the new wallet, error
+ */
+func createWallet(userId primitive.ObjectID, name string, personal bool) (primitive.ObjectID, error) {
+	newWallet := wallet{
+		Id:         primitive.NewObjectID(),
+		Name:       name,
+		Members:    []walletMember{{UserId: userId, Role: RoleOwner}},
+		CreateTime: time.Now(),
+	}
+	if personal {
+		newWallet.PersonalOf = &userId
+	}
+
+	_, err := getWalletsColl().InsertOne(context.TODO(), newWallet)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return newWallet.Id, nil
+}
+
+// findPersonalWallet returns the id of the user's personal wallet
+func findPersonalWallet(userId primitive.ObjectID) (primitive.ObjectID, error) {
+	var result wallet
+	err := getWalletsColl().FindOne(context.TODO(), bson.M{"personalOf": userId}).Decode(&result)
+	return result.Id, err
+}
+
+/**
+ * Find the wallet a request operates on and check the user's permission
+ * @param userId The user making the request
+ * @param walletIdStr The wallet id from the request, or empty for the user's personal wallet
+ * @param requiredRole The minimum role needed
+ * @return The wallet id, error (errWalletForbidden if the user lacks permission)
+ */
+func authorizeWallet(userId primitive.ObjectID, walletIdStr string, requiredRole string) (primitive.ObjectID, error) {
+	if walletIdStr == "" {
+		// Users always own their personal wallet
+		return findPersonalWallet(userId)
+	}
+
+	walletId, err := primitive.ObjectIDFromHex(walletIdStr)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	w, err := findWallet(walletId)
+	if err != nil {
+		return primitive.NilObjectID, errWalletForbidden
+	}
+	if !roleIncludes(getMemberRole(w, userId), requiredRole) {
+		return primitive.NilObjectID, errWalletForbidden
+	}
+	return walletId, nil
+}
+
+// countOwners returns the number of owners of the wallet
+func countOwners(w wallet) int {
+	count := 0
+	for _, member := range w.Members {
+		if member.Role == RoleOwner {
+			count++
+		}
+	}
+	return count
+}
+
+/**
+ * Change the role of a wallet member, or remove the member if role is empty.
+ * A wallet must always keep at least one owner
+ */
+func setMemberRole(walletId primitive.ObjectID, userId primitive.ObjectID, role string) error {
+	w, err := findWallet(walletId)
+	if err != nil {
+		return err
+	}
+	currentRole := getMemberRole(w, userId)
+	if currentRole == "" {
+		return errors.New("user is not a member of this wallet")
+	}
+	if currentRole == RoleOwner && role != RoleOwner && countOwners(w) == 1 {
+		return errors.New("a wallet must have at least one owner")
+	}
+	if w.PersonalOf != nil && *w.PersonalOf == userId && role != RoleOwner {
+		return errors.New("cannot leave a personal wallet")
+	}
+
+	if role == "" {
+		_, err = getWalletsColl().UpdateOne(context.TODO(), bson.M{"_id": walletId}, bson.M{
+			"$pull": bson.M{"members": bson.M{"user": userId}},
+		})
+	} else {
+		_, err = getWalletsColl().UpdateOne(context.TODO(), bson.M{"_id": walletId, "members.user": userId}, bson.M{
+			"$set": bson.M{"members.$.role": role},
+		})
+	}
+	return err
+}
+
+func hashInvitationCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+/**
+ * Create a single-use invitation code to join a wallet
+ * @param walletId The wallet to join
+ * @param role The role given to the invited user, viewer or editor
+ * @param createdBy The user creating the invitation
+ * @return The plain code, its expiry time, error
+ */
+func createInvitation(walletId primitive.ObjectID, role string, createdBy primitive.ObjectID) (string, time.Time, error) {
+	if role != RoleViewer && role != RoleEditor {
+		return "", time.Time{}, errors.New("invalid role")
+	}
+
+	code, err := generateSecureRandomString(24)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	// Only the hash is stored, so that codes cannot be read from the database
+	expires := time.Now().Add(invitationTtl)
+	_, err = getMetaColl().InsertOne(context.TODO(), bson.M{
+		"type":      "invitation",
+		"codeHash":  hashInvitationCode(code),
+		"wallet":    walletId,
+		"role":      role,
+		"createdBy": createdBy,
+		"expires":   expires,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return code, expires, nil
+}
+
+/**
+ * Join a wallet with an invitation code. The code is deleted once used
+ * @return The id of the joined wallet, error
+ */
+func acceptInvitation(userId primitive.ObjectID, code string) (primitive.ObjectID, error) {
+	var invitation struct {
+		Wallet  primitive.ObjectID `bson:"wallet"`
+		Role    string             `bson:"role"`
+		Expires time.Time          `bson:"expires"`
+	}
+	err := getMetaColl().FindOneAndDelete(context.TODO(), bson.M{
+		"type":     "invitation",
+		"codeHash": hashInvitationCode(code),
+	}).Decode(&invitation)
+	if err == mongo.ErrNoDocuments || (err == nil && time.Now().After(invitation.Expires)) {
+		return primitive.NilObjectID, errors.New("invalid or expired invitation")
+	} else if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	// Existing members keep their role
+	_, err = getWalletsColl().UpdateOne(context.TODO(), bson.M{
+		"_id":          invitation.Wallet,
+		"members.user": bson.M{"$ne": userId},
+	}, bson.M{
+		"$push": bson.M{"members": walletMember{UserId: userId, Role: invitation.Role}},
+	})
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return invitation.Wallet, nil
+}
+
+// successorOwner returns the member to hand a wallet without an owner to: the longest-standing
+// editor, else the longest-standing member. Members are kept in the order they joined
+func successorOwner(w wallet) (primitive.ObjectID, bool) {
+	for _, member := range w.Members {
+		if member.Role == RoleEditor {
+			return member.UserId, true
+		}
+	}
+	if len(w.Members) == 0 {
+		return primitive.NilObjectID, false
+	}
+	return w.Members[0].UserId, true
+}
+
+// removeUserFromWallets removes the user from all wallets. Wallets left without
+// any member are deleted together with their entries, and wallets left without
+// an owner are handed to one of their remaining members, see successorOwner
+func removeUserFromWallets(userId primitive.ObjectID) error {
+	walletIds, err := getWalletsColl().Distinct(context.TODO(), "_id", bson.M{"members.user": userId})
+	if err != nil {
+		return err
+	}
+	if len(walletIds) == 0 {
+		return nil
+	}
+
+	_, err = getWalletsColl().UpdateMany(context.TODO(), bson.M{"_id": bson.M{"$in": walletIds}}, bson.M{
+		"$pull": bson.M{"members": bson.M{"user": userId}},
+	})
+	if err != nil {
+		return err
+	}
+
+	cursor, err := getWalletsColl().Find(context.TODO(), bson.M{
+		"_id":          bson.M{"$in": walletIds},
+		"members.role": bson.M{"$ne": RoleOwner},
+	})
+	if err != nil {
+		return err
+	}
+	var ownerlessWallets []wallet
+	if err = cursor.All(context.Background(), &ownerlessWallets); err != nil {
+		return err
+	}
+	for _, w := range ownerlessWallets {
+		successor, hasMembers := successorOwner(w)
+		if hasMembers {
+			// The filter on the role keeps a concurrent change from leaving the wallet with two new owners
+			_, err = getWalletsColl().UpdateOne(context.TODO(), bson.M{
+				"_id":          w.Id,
+				"members.role": bson.M{"$ne": RoleOwner},
+			}, bson.M{
+				"$set": bson.M{"members.$[successor].role": RoleOwner},
+			}, options.Update().SetArrayFilters(options.ArrayFilters{
+				Filters: []interface{}{bson.M{"successor.user": successor}},
+			}))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = getEntriesColl().DeleteMany(context.TODO(), bson.M{"wallet": w.Id})
+		if err != nil {
+			return err
+		}
+		_, err = getRevisionsColl().DeleteMany(context.TODO(), bson.M{"wallet": w.Id})
+		if err != nil {
+			return err
+		}
+		_, err = getWalletsColl().DeleteOne(context.TODO(), bson.M{"_id": w.Id, "members": bson.M{"$size": 0}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateWallets creates a personal wallet for users who do not have one yet, and
+// moves their entries that do not belong to a wallet into it
+func migrateWallets() error {
+	users, err := getUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		walletId, err := findPersonalWallet(user.Id)
+		if err == mongo.ErrNoDocuments {
+			log.Println("Creating personal wallet for " + user.Username + "...")
+			walletId, err = createWallet(user.Id, "Personal", true)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = getEntriesColl().UpdateMany(context.TODO(), bson.M{
+			"owner":  user.Id,
+			"wallet": bson.M{"$exists": false},
+		}, bson.M{
+			"$set": bson.M{"wallet": walletId},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// COSE algorithm identifiers supported for passkeys
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+)
+
+// Authenticator data flags
+const (
+	authDataFlagUserPresent  = 0x01
+	authDataFlagUserVerified = 0x04
+	authDataFlagAttested     = 0x40
+)
+
+// Challenges handed out by the begin routes, keyed by challenge. The value is a webauthnChallenge
+var webauthnChallenges = newExpiringStore(5 * time.Minute)
+
+// webauthnChallenge is what a challenge was issued for
+type webauthnChallenge struct {
+	ceremony string
+	// The user registering a passkey, or NilObjectID for logins
+	userId primitive.ObjectID
+}
+
+var errPasskeyExists = errors.New("passkey is already registered")
+
+// passkeyCredential is the meta document of a registered passkey
+type passkeyCredential struct {
+	UserId       primitive.ObjectID `bson:"user" json:"-"`
+	CredentialId string             `bson:"credentialId" json:"id"`
+	PublicKey    []byte             `bson:"publicKey" json:"-"`
+	Algorithm    int64              `bson:"algorithm" json:"algorithm"`
+	SignCount    uint32             `bson:"signCount" json:"-"`
+	RpId         string             `bson:"rpId" json:"rpId"`
+	Name         string             `bson:"name" json:"name"`
+	CreateTime   time.Time          `bson:"createTime" json:"createTime"`
+	LastUsed     time.Time          `bson:"lastUsed" json:"lastUsed"`
+}
+
+// webauthnClientData is the relevant part of the clientDataJSON sent by the browser
+type webauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the parsed binary authenticator data
+type authenticatorData struct {
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialId []byte
+	publicKey    []byte
+}
+
+// decodeWebauthnBase64 decodes base64url data as sent by browsers, with or without padding
+func decodeWebauthnBase64(str string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(str, "="))
+}
+
+// getWebauthnOrigins returns the origins allowed to use passkeys, mapped to their relying party ID.
+// These are the CORS_DOMAINS, and the relying party ID is the host of each origin
+func getWebauthnOrigins() map[string]string {
+	origins := make(map[string]string)
+	for _, domain := range strings.Split(os.Getenv("CORS_DOMAINS"), ",") {
+		domain = strings.TrimSpace(domain)
+		u, err := url.Parse(domain)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		origins[domain] = u.Hostname()
+	}
+	return origins
+}
+
+// generateWebauthnChallenge creates a random challenge for a registration or login ceremony.
+// Registrations pass the id of the registering user, logins NilObjectID
+func generateWebauthnChallenge(ceremony string, userId primitive.ObjectID) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+	webauthnChallenges.put(challenge, webauthnChallenge{ceremony: ceremony, userId: userId})
+	return challenge, nil
+}
+
+// consumeWebauthnChallenge checks that a challenge was issued for the ceremony and user, and invalidates it
+func consumeWebauthnChallenge(challenge string, ceremony string, userId primitive.ObjectID) bool {
+	value, ok := webauthnChallenges.take(challenge)
+	if !ok {
+		return false
+	}
+	issued := value.(webauthnChallenge)
+	return issued.ceremony == ceremony && issued.userId == userId
+}
+
+/**
+ * Verify the client data of a ceremony
+ * @param clientDataJSON The raw clientDataJSON
+ * @param ceremonyType "webauthn.create" or "webauthn.get"
+ * @param origins The allowed origins mapped to their relying party ID
+ * @param checkChallenge Called with the challenge, returns whether it is valid
+ * @return The relying party ID of the origin, error
+ */
+func verifyWebauthnClientData(clientDataJSON []byte, ceremonyType string, origins map[string]string, checkChallenge func(string) bool) (string, error) {
+	var clientData webauthnClientData
+	err := json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil {
+		return "", err
+	}
+	if clientData.Type != ceremonyType {
+		return "", errors.New("unexpected ceremony type")
+	}
+	rpId, ok := origins[clientData.Origin]
+	if !ok {
+		return "", errors.New("origin not allowed")
+	}
+	if !checkChallenge(clientData.Challenge) {
+		return "", errors.New("invalid or expired challenge")
+	}
+	return rpId, nil
+}
+
+// parseAuthenticatorData parses authenticator data, including the attested credential data if present
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	var result authenticatorData
+	if len(data) < 37 {
+		return result, errors.New("authenticator data too short")
+	}
+	result.rpIdHash = data[:32]
+	result.flags = data[32]
+	result.signCount = binary.BigEndian.Uint32(data[33:37])
+
+	if result.flags&authDataFlagAttested != 0 {
+		// AAGUID (16 bytes), credential ID length (2 bytes), credential ID, COSE public key
+		rest := data[37:]
+		if len(rest) < 18 {
+			return result, errors.New("attested credential data too short")
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return result, errors.New("credential ID too short")
+		}
+		result.credentialId = rest[:idLen]
+		_, keyLen, err := decodeCbor(rest[idLen:])
+		if err != nil {
+			return result, err
+		}
+		result.publicKey = rest[idLen : idLen+keyLen]
+	}
+
+	return result, nil
+}
+
+/**
+ * Parse a COSE public key into a Go public key
+ * @return The public key, its COSE algorithm, error
+ */
+func parseCosePublicKey(coseKey []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := decodeCbor(coseKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("invalid COSE key")
+	}
+	kty, _ := cborInt(cborMapIntKey(m, 1))
+	alg, _ := cborInt(cborMapIntKey(m, 3))
+
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := cborInt(cborMapIntKey(m, -1))
+		x, okX := cborMapIntKey(m, -2).([]byte)
+		y, okY := cborMapIntKey(m, -3).([]byte)
+		if crv != 1 || !okX || !okY {
+			return nil, 0, errors.New("invalid EC2 key")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, errors.New("EC2 point is not on curve")
+		}
+		return key, alg, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, okN := cborMapIntKey(m, -1).([]byte)
+		e, okE := cborMapIntKey(m, -2).([]byte)
+		if !okN || !okE || len(e) > 4 {
+			return nil, 0, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, alg, nil
+	default:
+		return nil, 0, errors.New("unsupported key type or algorithm")
+	}
+}
+
+/**
+ * Verify a registration ceremony. The attestation statement is not verified, since
+ * registration only asks for "none" attestation
+ * @param clientDataJSON The raw clientDataJSON
+ * @param attestationObject The raw CBOR attestation object
+ * @param origins The allowed origins mapped to their relying party ID
+ * @param checkChallenge Called with the challenge, returns whether it is valid
+ * @return The new credential, error
+ */
+func verifyPasskeyRegistration(clientDataJSON []byte, attestationObject []byte, origins map[string]string, checkChallenge func(string) bool) (passkeyCredential, error) {
+	var credential passkeyCredential
+
+	rpId, err := verifyWebauthnClientData(clientDataJSON, "webauthn.create", origins, checkChallenge)
+	if err != nil {
+		return credential, err
+	}
+
+	// Parse the attestation object
+	decoded, _, err := decodeCbor(attestationObject)
+	if err != nil {
+		return credential, err
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return credential, errors.New("invalid attestation object")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return credential, errors.New("missing authenticator data")
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return credential, err
+	}
+
+	// Check the authenticator data
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	if !bytes.Equal(authData.rpIdHash, rpIdHash[:]) {
+		return credential, errors.New("relying party ID mismatch")
+	}
+	if authData.flags&authDataFlagUserPresent == 0 {
+		return credential, errors.New("user not present")
+	}
+	if authData.credentialId == nil {
+		return credential, errors.New("missing attested credential data")
+	}
+	_, alg, err := parseCosePublicKey(authData.publicKey)
+	if err != nil {
+		return credential, err
+	}
+
+	credential = passkeyCredential{
+		CredentialId: base64.RawURLEncoding.EncodeToString(authData.credentialId),
+		PublicKey:    authData.publicKey,
+		Algorithm:    alg,
+		SignCount:    authData.signCount,
+		RpId:         rpId,
+		CreateTime:   time.Now(),
+	}
+	return credential, nil
+}
+
+/**
+ * Verify a login (assertion) ceremony against a registered credential
+ * @param credential The registered credential
+ * @param clientDataJSON The raw clientDataJSON
+ * @param rawAuthData The raw authenticator data
+ * @param signature The assertion signature
+ * @param origins The allowed origins mapped to their relying party ID
+ * @param checkChallenge Called with the challenge, returns whether it is valid
+ * @param requireUserVerification Whether the authenticator must have verified the user (PIN, biometrics)
+ * @return The new signature counter, error
+ */
+func verifyPasskeyAssertion(credential passkeyCredential, clientDataJSON []byte, rawAuthData []byte, signature []byte, origins map[string]string, checkChallenge func(string) bool, requireUserVerification bool) (uint32, error) {
+	rpId, err := verifyWebauthnClientData(clientDataJSON, "webauthn.get", origins, checkChallenge)
+	if err != nil {
+		return 0, err
+	}
+	if rpId != credential.RpId {
+		return 0, errors.New("relying party ID mismatch")
+	}
+
+	// Check the authenticator data
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	if !bytes.Equal(authData.rpIdHash, rpIdHash[:]) {
+		return 0, errors.New("relying party ID mismatch")
+	}
+	if authData.flags&authDataFlagUserPresent == 0 {
+		return 0, errors.New("user not present")
+	}
+	if requireUserVerification && authData.flags&authDataFlagUserVerified == 0 {
+		return 0, errors.New("user not verified")
+	}
+
+	// A counter that does not increase indicates a cloned authenticator.
+	// Authenticators that do not implement the counter always report 0
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return 0, errors.New("signature counter did not increase")
+	}
+
+	// Verify the signature over authData || SHA-256(clientDataJSON)
+	publicKey, _, err := parseCosePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, rawAuthData...), clientDataHash[:]...))
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return 0, errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return 0, errors.New("invalid signature")
+		}
+	default:
+		return 0, errors.New("unsupported key type")
+	}
+
+	return authData.signCount, nil
+}
+
+func getPasskeys(userId primitive.ObjectID) ([]passkeyCredential, error) {
+	cursor, err := getMetaColl().Find(context.TODO(), bson.M{"type": "passkey", "user": userId})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []passkeyCredential
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+	if results == nil {
+		return []passkeyCredential{}, nil
+	}
+	return results, nil
+}
+
+func findPasskey(credentialId string) (passkeyCredential, error) {
+	var result passkeyCredential
+	err := getMetaColl().FindOne(context.TODO(), bson.M{"type": "passkey", "credentialId": credentialId}).Decode(&result)
+	return result, err
+}
+
+func insertPasskey(credential passkeyCredential) error {
+	_, err := getMetaColl().InsertOne(context.TODO(), bson.M{
+		"type":         "passkey",
+		"user":         credential.UserId,
+		"credentialId": credential.CredentialId,
+		"publicKey":    credential.PublicKey,
+		"algorithm":    credential.Algorithm,
+		"signCount":    credential.SignCount,
+		"rpId":         credential.RpId,
+		"name":         credential.Name,
+		"createTime":   credential.CreateTime,
+		"lastUsed":     time.Time{},
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return errPasskeyExists
+	}
+	return err
+}
+
+func updatePasskeyUsage(credentialId string, signCount uint32) error {
+	_, err := getMetaColl().UpdateOne(context.TODO(), bson.M{"type": "passkey", "credentialId": credentialId}, bson.M{
+		"$set": bson.M{
+			"signCount": signCount,
+			"lastUsed":  time.Now(),
+		},
+	})
+	return err
+}
+
+func deletePasskey(userId primitive.ObjectID, credentialId string) error {
+	_, err := getMetaColl().DeleteOne(context.TODO(), bson.M{"type": "passkey", "user": userId, "credentialId": credentialId})
+	return err
+}
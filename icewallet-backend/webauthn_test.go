@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	testOrigin    = "https://wallet.example.com"
+	testRpId      = "wallet.example.com"
+	testChallenge = "dGVzdCBjaGFsbGVuZ2U"
+)
+
+var testOrigins = map[string]string{testOrigin: testRpId}
+
+func checkTestChallenge(challenge string) bool {
+	return challenge == testChallenge
+}
+
+// cborHead encodes the initial byte and argument of a CBOR item
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(arg))
+		return b
+	default:
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(arg))
+		return b
+	}
+}
+
+// cborEncodeInt encodes an integer, for COSE map keys and values
+func cborEncodeInt(value int64) []byte {
+	if value < 0 {
+		return cborHead(1, uint64(-1-value))
+	}
+	return cborHead(0, uint64(value))
+}
+
+// cborEncodeMap encodes a map from its keys and values, which are already encoded and alternate
+func cborEncodeMap(items ...[]byte) []byte {
+	result := cborHead(5, uint64(len(items)/2))
+	for _, item := range items {
+		result = append(result, item...)
+	}
+	return result
+}
+
+func cborEncodeBytes(value []byte) []byte {
+	return append(cborHead(2, uint64(len(value))), value...)
+}
+
+func cborEncodeText(value string) []byte {
+	return append(cborHead(3, uint64(len(value))), value...)
+}
+
+// softAuthenticator is a software passkey holding an ES256 key, which builds ceremonies as a browser would
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, credentialId: []byte("soft-credential-1")}
+}
+
+// coseKey returns the public key in COSE_Key format
+func (a *softAuthenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return cborEncodeMap(
+		cborEncodeInt(1), cborEncodeInt(2),
+		cborEncodeInt(3), cborEncodeInt(coseAlgES256),
+		cborEncodeInt(-1), cborEncodeInt(1),
+		cborEncodeInt(-2), cborEncodeBytes(x),
+		cborEncodeInt(-3), cborEncodeBytes(y),
+	)
+}
+
+// authData builds authenticator data, with the attested credential data if attested is set
+func (a *softAuthenticator) authData(rpId string, flags byte, attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	if attested {
+		flags |= authDataFlagAttested
+	}
+	data = append(data, flags)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, byte(len(a.credentialId)>>8), byte(len(a.credentialId)))
+		data = append(data, a.credentialId...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func clientDataJson(t *testing.T, ceremonyType string, challenge string, origin string) []byte {
+	data, err := json.Marshal(webauthnClientData{Type: ceremonyType, Challenge: challenge, Origin: origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// register returns the clientDataJSON and attestation object of a registration with "none" attestation
+func (a *softAuthenticator) register(t *testing.T, rpId string, challenge string, origin string) ([]byte, []byte) {
+	attestation := cborEncodeMap(
+		cborEncodeText("fmt"), cborEncodeText("none"),
+		cborEncodeText("attStmt"), cborEncodeMap(),
+		cborEncodeText("authData"), cborEncodeBytes(a.authData(rpId, authDataFlagUserPresent|authDataFlagUserVerified, true)),
+	)
+	return clientDataJson(t, "webauthn.create", challenge, origin), attestation
+}
+
+// sign returns the signature of an assertion over authData || SHA-256(clientDataJSON)
+func (a *softAuthenticator) sign(t *testing.T, authData []byte, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func TestVerifyPasskeyRegistration(t *testing.T) {
+	authenticator := newSoftAuthenticator(t)
+	authenticator.signCount = 1
+
+	clientData, attestation := authenticator.register(t, testRpId, testChallenge, testOrigin)
+	credential, err := verifyPasskeyRegistration(clientData, attestation, testOrigins, checkTestChallenge)
+	if err != nil {
+		t.Fatalf("verifyPasskeyRegistration() error = %v", err)
+	}
+	if credential.CredentialId != base64.RawURLEncoding.EncodeToString(authenticator.credentialId) {
+		t.Errorf("CredentialId = %s", credential.CredentialId)
+	}
+	if credential.Algorithm != coseAlgES256 || credential.RpId != testRpId || credential.SignCount != 1 {
+		t.Errorf("credential = %+v", credential)
+	}
+	if string(credential.PublicKey) != string(authenticator.coseKey()) {
+		t.Errorf("PublicKey = %x, want %x", credential.PublicKey, authenticator.coseKey())
+	}
+}
+
+func TestVerifyPasskeyRegistrationRejected(t *testing.T) {
+	authenticator := newSoftAuthenticator(t)
+	validClientData, validAttestation := authenticator.register(t, testRpId, testChallenge, testOrigin)
+	_, wrongRpAttestation := authenticator.register(t, "evil.example.com", testChallenge, testOrigin)
+	notPresentAttestation := cborEncodeMap(
+		cborEncodeText("fmt"), cborEncodeText("none"),
+		cborEncodeText("authData"), cborEncodeBytes(authenticator.authData(testRpId, 0, true)),
+	)
+	notAttestedAttestation := cborEncodeMap(
+		cborEncodeText("fmt"), cborEncodeText("none"),
+		cborEncodeText("authData"), cborEncodeBytes(authenticator.authData(testRpId, authDataFlagUserPresent, false)),
+	)
+	truncatedAuthData := authenticator.authData(testRpId, authDataFlagUserPresent, true)
+	truncatedAttestation := cborEncodeMap(
+		cborEncodeText("authData"), cborEncodeBytes(truncatedAuthData[:len(truncatedAuthData)-10]),
+	)
+
+	tests := []struct {
+		name        string
+		clientData  []byte
+		attestation []byte
+	}{
+		{name: "wrong rpIdHash", clientData: validClientData, attestation: wrongRpAttestation},
+		{name: "wrong origin", clientData: clientDataJson(t, "webauthn.create", testChallenge, "https://evil.example.com"), attestation: validAttestation},
+		{name: "wrong challenge", clientData: clientDataJson(t, "webauthn.create", "b3RoZXI", testOrigin), attestation: validAttestation},
+		{name: "login ceremony", clientData: clientDataJson(t, "webauthn.get", testChallenge, testOrigin), attestation: validAttestation},
+		{name: "invalid clientDataJSON", clientData: []byte("{"), attestation: validAttestation},
+		{name: "user not present", clientData: validClientData, attestation: notPresentAttestation},
+		{name: "no attested credential", clientData: validClientData, attestation: notAttestedAttestation},
+		{name: "truncated public key", clientData: validClientData, attestation: truncatedAttestation},
+		{name: "missing authData", clientData: validClientData, attestation: cborEncodeMap(cborEncodeText("fmt"), cborEncodeText("none"))},
+		{name: "attestation is not a map", clientData: validClientData, attestation: cborEncodeText("authData")},
+		{name: "truncated attestation", clientData: validClientData, attestation: validAttestation[:len(validAttestation)/2]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := verifyPasskeyRegistration(test.clientData, test.attestation, testOrigins, checkTestChallenge); err == nil {
+				t.Error("verifyPasskeyRegistration() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestVerifyPasskeyAssertion(t *testing.T) {
+	authenticator := newSoftAuthenticator(t)
+	credential := passkeyCredential{PublicKey: authenticator.coseKey(), Algorithm: coseAlgES256, SignCount: 4, RpId: testRpId}
+	other := newSoftAuthenticator(t)
+
+	type assertion struct {
+		clientData []byte
+		authData   []byte
+		signature  []byte
+	}
+	// login builds a signed assertion, with the counter of the authenticator set to signCount
+	login := func(signer *softAuthenticator, signCount uint32, rpId string, flags byte, origin string, challenge string) assertion {
+		authenticator.signCount = signCount
+		clientData := clientDataJson(t, "webauthn.get", challenge, origin)
+		authData := authenticator.authData(rpId, flags, false)
+		return assertion{clientData: clientData, authData: authData, signature: signer.sign(t, authData, clientData)}
+	}
+	present := byte(authDataFlagUserPresent)
+	verified := byte(authDataFlagUserPresent | authDataFlagUserVerified)
+
+	// Signatures that do not cover the data sent
+	tampered := login(authenticator, 5, testRpId, present, testOrigin, testChallenge)
+	tampered.authData[36] = 6
+	corrupted := login(authenticator, 5, testRpId, present, testOrigin, testChallenge)
+	corrupted.signature[len(corrupted.signature)-1] ^= 0xff
+
+	tests := []struct {
+		name                    string
+		assertion               assertion
+		credentialSignCount     uint32
+		requireUserVerification bool
+		wantSignCount           uint32
+		wantErr                 bool
+	}{
+		{name: "valid", assertion: login(authenticator, 5, testRpId, present, testOrigin, testChallenge), credentialSignCount: 4, wantSignCount: 5},
+		{name: "counter jumps", assertion: login(authenticator, 100, testRpId, present, testOrigin, testChallenge), credentialSignCount: 4, wantSignCount: 100},
+		{name: "user verified", assertion: login(authenticator, 5, testRpId, verified, testOrigin, testChallenge), credentialSignCount: 4, requireUserVerification: true, wantSignCount: 5},
+		{name: "counter not implemented", assertion: login(authenticator, 0, testRpId, present, testOrigin, testChallenge), credentialSignCount: 0, wantSignCount: 0},
+		{name: "replayed counter", assertion: login(authenticator, 4, testRpId, present, testOrigin, testChallenge), credentialSignCount: 4, wantErr: true},
+		{name: "decreasing counter", assertion: login(authenticator, 3, testRpId, present, testOrigin, testChallenge), credentialSignCount: 4, wantErr: true},
+		{name: "counter reset to zero", assertion: login(authenticator, 0, testRpId, present, testOrigin, testChallenge), credentialSignCount: 4, wantErr: true},
+		{name: "wrong rpIdHash", assertion: login(authenticator, 5, "evil.example.com", present, testOrigin, testChallenge), credentialSignCount: 4, wantErr: true},
+		{name: "wrong origin", assertion: login(authenticator, 5, testRpId, present, "https://evil.example.com", testChallenge), credentialSignCount: 4, wantErr: true},
+		{name: "wrong challenge", assertion: login(authenticator, 5, testRpId, present, testOrigin, "b3RoZXI"), credentialSignCount: 4, wantErr: true},
+		{name: "registration ceremony", assertion: assertion{
+			clientData: clientDataJson(t, "webauthn.create", testChallenge, testOrigin),
+			authData:   tampered.authData,
+		}, credentialSignCount: 4, wantErr: true},
+		{name: "user not present", assertion: login(authenticator, 5, testRpId, 0, testOrigin, testChallenge), credentialSignCount: 4, wantErr: true},
+		{name: "user not verified", assertion: login(authenticator, 5, testRpId, present, testOrigin, testChallenge), credentialSignCount: 4, requireUserVerification: true, wantErr: true},
+		{name: "signed by another key", assertion: login(other, 5, testRpId, present, testOrigin, testChallenge), credentialSignCount: 4, wantErr: true},
+		{name: "tampered authenticator data", assertion: tampered, credentialSignCount: 4, wantErr: true},
+		{name: "corrupted signature", assertion: corrupted, credentialSignCount: 4, wantErr: true},
+		{name: "truncated authenticator data", assertion: assertion{
+			clientData: tampered.clientData,
+			authData:   tampered.authData[:36],
+			signature:  tampered.signature,
+		}, credentialSignCount: 4, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			credential.SignCount = test.credentialSignCount
+			signCount, err := verifyPasskeyAssertion(credential, test.assertion.clientData, test.assertion.authData,
+				test.assertion.signature, testOrigins, checkTestChallenge, test.requireUserVerification)
+			if test.wantErr {
+				if err == nil {
+					t.Error("verifyPasskeyAssertion() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyPasskeyAssertion() error = %v", err)
+			}
+			if signCount != test.wantSignCount {
+				t.Errorf("verifyPasskeyAssertion() = %d, want %d", signCount, test.wantSignCount)
+			}
+		})
+	}
+}
+
+func TestVerifyPasskeyAssertionOtherRelyingParty(t *testing.T) {
+	// A credential registered on one domain cannot be used from another allowed domain
+	authenticator := newSoftAuthenticator(t)
+	credential := passkeyCredential{PublicKey: authenticator.coseKey(), Algorithm: coseAlgES256, RpId: "other.example.com"}
+	clientData := clientDataJson(t, "webauthn.get", testChallenge, testOrigin)
+	authData := authenticator.authData(testRpId, authDataFlagUserPresent, false)
+	_, err := verifyPasskeyAssertion(credential, clientData, authData, authenticator.sign(t, authData, clientData),
+		testOrigins, checkTestChallenge, false)
+	if err == nil {
+		t.Error("verifyPasskeyAssertion() succeeded, want error")
+	}
+}
+
+func TestConsumeWebauthnChallenge(t *testing.T) {
+	user := primitive.NewObjectID()
+	tests := []struct {
+		name     string
+		ceremony string
+		userId   primitive.ObjectID
+		want     bool
+	}{
+		{name: "same ceremony and user", ceremony: "register", userId: user, want: true},
+		{name: "other ceremony", ceremony: "login", userId: user},
+		{name: "other user", ceremony: "register", userId: primitive.NewObjectID()},
+		{name: "no user", ceremony: "register", userId: primitive.NilObjectID},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			challenge, err := generateWebauthnChallenge("register", user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := consumeWebauthnChallenge(challenge, test.ceremony, test.userId); got != test.want {
+				t.Errorf("consumeWebauthnChallenge() = %v, want %v", got, test.want)
+			}
+			// A challenge can only be used once
+			if consumeWebauthnChallenge(challenge, "register", user) {
+				t.Error("consumeWebauthnChallenge() accepted a used challenge")
+			}
+		})
+	}
+}
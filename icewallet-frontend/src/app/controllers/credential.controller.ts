@@ -5,6 +5,12 @@ import * as Forge from 'node-forge';
 import { HttpClient, HttpErrorResponse } from "@angular/common/http";
 import { catchError, throwError } from "rxjs";
 
+export interface LoginResult {
+  token?: string;
+  twoFactorRequired?: boolean;
+  ticket?: string;
+}
+
 @Injectable()
 export class CredentialController {
   constructor(
@@ -13,9 +19,31 @@ export class CredentialController {
     private appStorageCtrl: AppStorageController
   ) {}
 
-  encryptWithPublicKey(content: string): string {
+  /**
+   * Seal a password together with a single-use nonce using RSA-OAEP (SHA-256)
+   */
+  sealWithPublicKey(password: string, nonce: string): string {
     const rsa = Forge.pki.publicKeyFromPem(this.appStorageCtrl.getServerPublicKey());
-    return window.btoa(rsa.encrypt(content, 'RSAES-PKCS1-V1_5'));
+    const payload = Forge.util.encodeUtf8(JSON.stringify({ password: password, nonce: nonce }));
+    return window.btoa(rsa.encrypt(payload, 'RSA-OAEP', {
+      md: Forge.md.sha256.create(),
+      mgf1: { md: Forge.md.sha256.create() }
+    }));
+  }
+
+  getLoginNonce(): Promise<string> {
+    return new Promise((resolve, reject) => {
+      this.http.get<any>(this.appStorageCtrl.getServerUrl() + "/getLoginNonce")
+        .pipe(catchError((err: HttpErrorResponse) => {
+          this.genCtrl.handleError(err);
+          reject(typeof err.error === 'object' ? err.message : err.error);
+          return throwError(() => { new Error(typeof err.error === 'object' ? err.message : err.error) });
+        }))
+
+        .subscribe((res: any) => {
+          resolve(res.nonce);
+        });
+    });
   }
 
   getServerPublicKey(): Promise<string> {
@@ -33,20 +61,47 @@ export class CredentialController {
     });
   }
 
-  login(password: string): Promise<string> {
-    // Encrypt the password using server's public key
-    let encryptedPassword: string;
-    try {
-      encryptedPassword = this.encryptWithPublicKey(password);
-    }
-    catch (err) {
-      return Promise.reject(err);
-    }
+  /**
+   * Log in with a username and password. Resolves with { token } when logged in, or with
+   * { twoFactorRequired: true, ticket } when a code must then be sent to loginTwoFactor
+   */
+  async login(username: string, password: string): Promise<LoginResult> {
+    // Encrypt the password and a fresh nonce using server's public key
+    const nonce = await this.getLoginNonce();
+    const encryptedPassword = this.sealWithPublicKey(password, nonce);
 
     // Send the encrypted password to the server, who has to
     // have the corresponding private key to decrypt the password
     return new Promise((resolve, reject) => {
-      this.http.post<any>(this.appStorageCtrl.getServerUrl() + "/login", { password: encryptedPassword })
+      this.http.post<any>(this.appStorageCtrl.getServerUrl() + "/login", {
+        username: username,
+        password: encryptedPassword,
+        scheme: "rsa-oaep-sha256",
+      })
+        .pipe(catchError((err: HttpErrorResponse) => {
+          this.genCtrl.handleError(err);
+          reject(typeof err.error === 'object' ? err.message : err.error);
+          return throwError(() => { new Error(typeof err.error === 'object' ? err.message : err.error) });
+        }))
+
+        .subscribe((res: any) => {
+          // Check the response
+          if (res.token || (res.twoFactorRequired && res.ticket)) {
+            resolve(res);
+          }
+          else {
+            reject(res.message);
+          }
+        });
+    });
+  }
+
+  loginTwoFactor(ticket: string, code: string): Promise<string> {
+    return new Promise((resolve, reject) => {
+      this.http.post<any>(this.appStorageCtrl.getServerUrl() + "/loginTwoFactor", {
+        ticket: ticket,
+        code: code,
+      })
         .pipe(catchError((err: HttpErrorResponse) => {
           this.genCtrl.handleError(err);
           reject(typeof err.error === 'object' ? err.message : err.error);
@@ -95,19 +150,21 @@ export class CredentialController {
     });
   }
 
-  changePassword(oldPassword: string, newPassword: string): Promise<boolean> {
-    // Encrypt the password using server's public key
+  async changePassword(oldPassword: string, newPassword: string): Promise<boolean> {
+    // Encrypt the passwords using server's public key. Both share the same nonce
     let encryptedOldPassword: string;
     let encryptedNewPassword: string;
 
     try {
-      encryptedOldPassword = this.encryptWithPublicKey(oldPassword);
-      encryptedNewPassword = this.encryptWithPublicKey(newPassword);
+      const nonce = await this.getLoginNonce();
+      encryptedOldPassword = this.sealWithPublicKey(oldPassword, nonce);
+      encryptedNewPassword = this.sealWithPublicKey(newPassword, nonce);
 
       return new Promise((resolve, reject) => {
         this.http.post<any>(this.appStorageCtrl.getServerUrl() + "/changePassword", {
           oldPassword: encryptedOldPassword,
           newPassword: encryptedNewPassword,
+          scheme: "rsa-oaep-sha256",
         }, this.genCtrl.getAuthHeader())
           .pipe(catchError((err: HttpErrorResponse) => {
             this.genCtrl.handleError(err);
@@ -54,10 +54,14 @@ export class EntryController {
     });
   }
 
-  updateEntry(id: string, description: string, amount: number, date: Date): Promise<boolean> {
+  /**
+   * Update an entry. Rejects if the entry was changed elsewhere since the given version was read
+   */
+  updateEntry(id: string, version: number, description: string, amount: number, date: Date): Promise<boolean> {
     return new Promise((resolve, reject) => {
       this.http.post<any>(this.appStorageCtrl.getServerUrl() + "/updateEntry", {
         id: id,
+        version: version,
         description: description,
         amount: amount,
         date: date
@@ -74,10 +78,11 @@ export class EntryController {
     });
   }
 
-  deleteEntry(id: string): Promise<boolean> {
+  deleteEntry(id: string, version: number): Promise<boolean> {
     return new Promise((resolve, reject) => {
       this.http.post<any>(this.appStorageCtrl.getServerUrl() + "/deleteEntry", {
-        id: id
+        id: id,
+        version: version
       }, this.genCtrl.getAuthHeader())
         .pipe(catchError((err: HttpErrorResponse) => {
           this.genCtrl.handleError(err);
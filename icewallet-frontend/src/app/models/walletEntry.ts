@@ -6,4 +6,5 @@ export class WalletEntry {
   description: string = '';
   date: Date = new Date();
   createTime: Date = new Date();
+  version: number = 1;
 }
@@ -1,7 +1,7 @@
 import { Component, OnInit } from '@angular/core';
 import { Router } from '@angular/router';
 import { AppStorageController } from "../../controllers/appstorage.controller";
-import { CredentialController } from "../../controllers/credential.controller";
+import { CredentialController, LoginResult } from "../../controllers/credential.controller";
 import {NgbModal} from "@ng-bootstrap/ng-bootstrap";
 
 @Component({
@@ -11,8 +11,13 @@ import {NgbModal} from "@ng-bootstrap/ng-bootstrap";
 })
 export class LoginComponent implements OnInit {
   specifyServer: boolean = false;
+  username: string = '';
   password: string = '';
 
+  // Set when the password was accepted and a two-factor code is needed
+  twoFactorTicket: string = '';
+  twoFactorCode: string = '';
+
   apiUrl: string = '';
   publicKey: string = '';
 
@@ -52,7 +57,16 @@ export class LoginComponent implements OnInit {
   }
 
   login() {
+    if (this.twoFactorTicket) {
+      this.loginTwoFactor();
+      return;
+    }
+
     // Check for invalid info
+    if (this.username.length === 0) {
+      this.loginError = 'Please enter a username';
+      return;
+    }
     if (this.password.length === 0) {
       this.loginError = 'Please enter a password';
       return;
@@ -68,16 +82,52 @@ export class LoginComponent implements OnInit {
       this.saveServerInfo();
     }
 
-    this.credentialCtrl.login(this.password)
+    this.credentialCtrl.login(this.username, this.password)
+      .then((res: LoginResult) => {
+        if (res.twoFactorRequired && res.ticket) {
+          // Ask for the code
+          this.twoFactorTicket = res.ticket;
+          this.twoFactorCode = '';
+          return;
+        }
+        this.appStorageCtrl.setLoginToken(res.token!);
+        this.router.navigate(['/']);
+      })
+      .catch((err: any) => {
+        this.loginError = err;
+      });
+  }
+
+  loginTwoFactor() {
+    if (this.twoFactorCode.length === 0) {
+      this.loginError = 'Please enter the code from your authenticator app, or a recovery code';
+      return;
+    }
+    this.loginError = '';
+
+    this.credentialCtrl.loginTwoFactor(this.twoFactorTicket, this.twoFactorCode.trim())
       .then((token: string) => {
         this.appStorageCtrl.setLoginToken(token);
         this.router.navigate(['/']);
       })
       .catch((err: any) => {
+        // The ticket expires after a few minutes or too many wrong codes, then the password is needed again
+        if (typeof err === 'string' && err.startsWith('Invalid ticket')) {
+          this.cancelTwoFactor();
+          this.loginError = 'The login expired, please enter your password again';
+          return;
+        }
         this.loginError = err;
       });
   }
 
+  cancelTwoFactor() {
+    this.loginError = '';
+    this.twoFactorTicket = '';
+    this.twoFactorCode = '';
+    this.password = '';
+  }
+
   saveServerInfo() {
     this.appStorageCtrl.setServerUrl(this.apiUrl);
     this.appStorageCtrl.setServerPublicKey(this.publicKey);
@@ -33,6 +33,7 @@ export class ManageEntriesComponent implements OnInit {
   editingDate: string = '';
   prevEditingDate: Date = new Date();
   editingId: string = '';
+  editingVersion: number = 1;
 
   manageEntryError: string = '';
   editEntryError: string = '';
@@ -275,6 +276,7 @@ export class ManageEntriesComponent implements OnInit {
     this.prevEditingDate = new Date(entry.date);
     this.editingDate = entry.date.toString().split('T')[0];
     this.editingId = entry._id;
+    this.editingVersion = entry.version;
     this.editEntryError = '';
     this.openPopup(popupModal);
   }
@@ -300,7 +302,7 @@ export class ManageEntriesComponent implements OnInit {
     newDate.setFullYear(Number(splitTmp[0]), Number(splitTmp[1]) - 1, Number(splitTmp[2]));
 
     this.genCtrl.showLoading(true);
-    this.entryCtrl.updateEntry(this.editingId, this.editingDesc, Number(this.editingAmount), newDate)
+    this.entryCtrl.updateEntry(this.editingId, this.editingVersion, this.editingDesc, Number(this.editingAmount), newDate)
       .then(() => {
         this.getEntries();
         modal.close();
@@ -323,7 +325,7 @@ export class ManageEntriesComponent implements OnInit {
     this.deleteEntryError = '';
 
     this.genCtrl.showLoading(true);
-    this.entryCtrl.deleteEntry(this.deleteEntry._id)
+    this.entryCtrl.deleteEntry(this.deleteEntry._id, this.deleteEntry.version)
       .then(() => {
         this.getEntries();
         modal.close();